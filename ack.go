@@ -0,0 +1,116 @@
+package nsq
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+)
+
+// HeaderDeliveryID is set on received messages when WithManualAck is used. It
+// identifies the delivery for Ack and Nack.
+const HeaderDeliveryID = "X-Delivery-ID"
+
+// ErrUnknownDelivery is returned by Ack and Nack when the message isn't
+// awaiting acknowledgement, e.g. it was already acknowledged.
+var ErrUnknownDelivery = errors.New("message is not awaiting acknowledgement")
+
+// ErrAckTimeout is the reason messages not acknowledged before their timeout
+// are requeued, see WithManualAck.
+var ErrAckTimeout = errors.New("message not acknowledged before its timeout")
+
+// defaultMsgTimeout is the default --msg-timeout of nsqd, used when consumers
+// don't set one.
+const defaultMsgTimeout = time.Minute
+
+// WithManualAck makes subscriptions wait for Ack or Nack on every received
+// message instead of finishing it as soon as it's delivered, giving
+// at-least-once delivery. Nacked messages are requeued by NSQ, with backoff,
+// and their attempts count increases: a RequeueAfter reason sets the delay.
+//
+// Every received message must be acknowledged: NSQ doesn't deliver more than
+// MaxInFlight messages at once to a consumer, and up to that many can await
+// acknowledgement, whatever WithConcurrentHandlers. Messages not acknowledged
+// before their timeout (see WithMsgTimeout) are requeued, unless WithAutoTouch
+// keeps them alive: a late Ack or Nack returns ErrUnknownDelivery.
+func WithManualAck() ControllerOption {
+	return func(controller *Controller) { controller.manualAck = true }
+}
+
+// Ack marks the message as processed, so NSQ finishes it.
+func (c *Controller) Ack(bm extensions.BrokerMessage) error {
+	return c.Nack(bm, nil)
+}
+
+// Nack marks the message as failed, so NSQ requeues it. A nil reason acks it.
+func (c *Controller) Nack(bm extensions.BrokerMessage, reason error) error {
+	id := string(bm.Headers[HeaderDeliveryID])
+
+	c.acksMu.Lock()
+	ack, ok := c.pendingAcks[id]
+	delete(c.pendingAcks, id)
+	c.acksMu.Unlock()
+
+	if !ok {
+		return ErrUnknownDelivery
+	}
+
+	ack <- reason
+
+	return nil
+}
+
+// awaitAck registers a new delivery. The channel gets the Ack/Nack result.
+func (c *Controller) awaitAck() (id string, ack <-chan error) {
+	id = strconv.FormatUint(c.deliveries.Add(1), 10)
+	ch := make(chan error, 1)
+
+	c.acksMu.Lock()
+	c.pendingAcks[id] = ch
+	c.acksMu.Unlock()
+
+	return id, ch
+}
+
+// WithDeadLetterHandler sets a function called with messages exceeding
+// MaxAttempts (see WithMaxAttempts), right before they're given up. They're
+// decoded like received messages, and X-Attempts header holds the final
+// attempts count.
+//
+// fn runs synchronously on the goroutine handling NSQ messages, so it blocks
+// the delivery of subsequent messages until it returns.
+func WithDeadLetterHandler(fn func(extensions.BrokerMessage)) ControllerOption {
+	return func(controller *Controller) { controller.deadLetter = fn }
+}
+
+// WithAutoTouch makes subscriptions touch every message still in process
+// each interval, so nsqd doesn't requeue it after MsgTimeout. Interval should
+// be well below MsgTimeout.
+//
+// Touched messages still count as in-flight, so slow messages hold
+// MaxInFlight slots for as long as they're processed.
+func WithAutoTouch(interval time.Duration) ControllerOption {
+	return func(controller *Controller) { controller.autoTouch = interval }
+}
+
+// ackTimeout returns how long to wait for a message acknowledgement, or 0 to
+// wait as long as needed with WithAutoTouch.
+func (c *Controller) ackTimeout() time.Duration {
+	switch {
+	case c.autoTouch > 0:
+		return 0
+	case c.consumerConfig.MsgTimeout > 0:
+		return c.consumerConfig.MsgTimeout
+	default:
+		return defaultMsgTimeout
+	}
+}
+
+// forgetAck unregisters a delivery that won't be acknowledged.
+func (c *Controller) forgetAck(id string) {
+	c.acksMu.Lock()
+	defer c.acksMu.Unlock()
+
+	delete(c.pendingAcks, id)
+}
@@ -0,0 +1,120 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+)
+
+// adaptiveMaxInFlight tunes the max in flight of each subscription from the
+// depth of its channel, see WithAdaptiveMaxInFlight.
+type adaptiveMaxInFlight struct {
+	min, max int
+	interval time.Duration
+	addrs    []string // nsqd HTTP addresses
+}
+
+// WithAdaptiveMaxInFlight makes each subscription tune its MaxInFlight between
+// minInFlight and maxInFlight, from the depth of its channel sampled every
+// sampleInterval on the given nsqd HTTP addresses (e.g. "nsqd:4151").
+// MaxInFlight doubles while messages wait in the channel, and halves once it's
+// caught up.
+//
+// Every sample queries /stats on each address, for each subscription: keep
+// the interval in seconds rather than milliseconds with many of them. It
+// can't be combined with WithGlobalMaxInFlight or WithOrderedDelivery.
+func WithAdaptiveMaxInFlight(minInFlight, maxInFlight int, sampleInterval time.Duration, nsqdHTTPAddrs ...string) ControllerOption {
+	switch {
+	case minInFlight < 1 || maxInFlight < minInFlight:
+		return withError(fmt.Errorf("invalid adaptive max in flight bounds [%d, %d]: must be at least 1 and ordered", minInFlight, maxInFlight))
+	case sampleInterval <= 0:
+		return withError(fmt.Errorf("invalid adaptive max in flight sample interval %v: must be positive", sampleInterval))
+	case len(nsqdHTTPAddrs) == 0:
+		return withError(errors.New("adaptive max in flight needs nsqd http addresses to sample"))
+	}
+
+	return func(controller *Controller) {
+		controller.adaptive = &adaptiveMaxInFlight{min: minInFlight, max: maxInFlight, interval: sampleInterval, addrs: nsqdHTTPAddrs}
+	}
+}
+
+// initial returns the max in flight subscriptions start with: the configured
+// one, within bounds.
+func (a *adaptiveMaxInFlight) initial(configured int) int {
+	return min(max(configured, a.min), a.max)
+}
+
+// next returns the max in flight following current, given the channel depth.
+func (a *adaptiveMaxInFlight) next(current int, depth int64) int {
+	switch {
+	case depth > int64(current):
+		return min(current*2, a.max)
+	case depth < int64(current/2):
+		return max(current/2, a.min)
+	default:
+		return current
+	}
+}
+
+// tuneMaxInFlight adjusts the max in flight of s from its channel depth, until
+// it stops or the controller shuts down.
+func (c *Controller) tuneMaxInFlight(s *subscription) {
+	ticker := time.NewTicker(c.adaptive.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		case <-c.shutdown:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.adaptive.interval)
+		depth, err := c.channelDepth(ctx, s.topic, s.channel)
+		cancel()
+		if err != nil {
+			c.logger.Warning(ctx, "sampling channel depth failed",
+				extensions.LogInfo{Key: "topic", Value: s.topic},
+				extensions.LogInfo{Key: "channel", Value: s.channel},
+				extensions.LogInfo{Key: "error", Value: err.Error()})
+			continue
+		}
+
+		c.mu.Lock()
+		if n := c.adaptive.next(s.maxInFlight, depth); n != s.maxInFlight {
+			s.maxInFlight = n
+			if !s.paused {
+				s.consumer.ChangeMaxInFlight(n)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// channelDepth sums the depth of channel of topic on the sampled nsqd.
+func (c *Controller) channelDepth(ctx context.Context, topic, channel string) (int64, error) {
+	var depth int64
+	for _, addr := range c.adaptive.addrs {
+		var stats NodeStats
+		query := url.Values{"format": {"json"}, "topic": {topic}, "channel": {channel}}
+		if err := c.getJSON(ctx, addr, "/stats", query, &stats); err != nil {
+			return 0, fmt.Errorf("trying to get stats from nsqd %s: %w", addr, err)
+		}
+
+		for _, t := range stats.Topics {
+			for _, ch := range t.Channels {
+				if t.TopicName == topic && ch.ChannelName == channel {
+					depth += ch.Depth
+				}
+			}
+		}
+	}
+
+	return depth, nil
+}
@@ -0,0 +1,59 @@
+package nsq
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+)
+
+// EmptyChannel drops every message waiting in channel of topic on a nsqd node,
+// in memory and on disk. In-flight messages are left alone.
+//
+// Like other administrative operations, it needs the nsqd HTTP address (e.g.
+// "nsqd:4151"), not the TCP one used to publish and consume.
+func (c *Controller) EmptyChannel(ctx context.Context, nsqdHTTPAddr, topic, channel string) error {
+	return c.channelAction(ctx, nsqdHTTPAddr, "/channel/empty", "emptying", topic, channel)
+}
+
+// PauseChannel stops a nsqd node from delivering messages of channel to its
+// consumers, for all clients, until UnpauseChannel is called. Messages keep
+// piling up meanwhile. It needs the nsqd HTTP address.
+func (c *Controller) PauseChannel(ctx context.Context, nsqdHTTPAddr, topic, channel string) error {
+	return c.channelAction(ctx, nsqdHTTPAddr, "/channel/pause", "pausing", topic, channel)
+}
+
+// UnpauseChannel resumes delivery of a channel paused by PauseChannel. It
+// needs the nsqd HTTP address.
+func (c *Controller) UnpauseChannel(ctx context.Context, nsqdHTTPAddr, topic, channel string) error {
+	return c.channelAction(ctx, nsqdHTTPAddr, "/channel/unpause", "unpausing", topic, channel)
+}
+
+// channelAction posts to a nsqd channel endpoint. Non 200 responses return a
+// *statusError.
+func (c *Controller) channelAction(ctx context.Context, addr, path, action, topic, channel string) error {
+	if err := validateName("topic", topic); err != nil {
+		return err
+	}
+	if err := validateName("channel", channel); err != nil {
+		return err
+	}
+
+	resp, err := c.doHTTP(ctx, http.MethodPost, addr, path, url.Values{"topic": {topic}, "channel": {channel}})
+	if err == nil {
+		err = resp.Body.Close()
+	}
+	if c.logging {
+		c.logResult(ctx, action+" channel", err,
+			extensions.LogInfo{Key: "address", Value: addr},
+			extensions.LogInfo{Key: "topic", Value: topic},
+			extensions.LogInfo{Key: "channel", Value: channel})
+	}
+	if err != nil {
+		return fmt.Errorf("%s channel %q of topic %q on nsqd %s: %w", action, channel, topic, addr, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package nsq
+
+import "github.com/nsqio/go-nsq"
+
+// Producer returns the go-nsq producer to the controller address, to use
+// go-nsq features the controller doesn't wrap.
+//
+// Use it with care: the controller doesn't track what's done with it, and
+// stops it on Close. It's also replaced once its connection breaks while
+// publishing, so don't keep it around.
+func (c *Controller) Producer() *nsq.Producer {
+	c.producersMu.RLock()
+	defer c.producersMu.RUnlock()
+
+	return c.producers[0]
+}
+
+// Consumers returns the go-nsq consumers of topic, only the one of its channel
+// with a '#channel' suffix, to use go-nsq features the controller doesn't
+// wrap.
+//
+// Use them with care: the controller doesn't track what's done with them, and
+// stops them when their subscription is canceled.
+func (c *Controller) Consumers(topic string) []*nsq.Consumer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	subs := c.matchSubscriptions(topic)
+	consumers := make([]*nsq.Consumer, len(subs))
+	for i, s := range subs {
+		consumers[i] = s.consumer
+	}
+
+	return consumers
+}
+
+// Consumer returns the go-nsq consumer of the subscription, see
+// Controller.Consumers.
+func (ds *DeliverySubscription) Consumer() *nsq.Consumer { return ds.sub.consumer }
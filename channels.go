@@ -0,0 +1,49 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+	"github.com/nsqio/go-nsq"
+)
+
+// SubscribeChannels subscribes to topic once per channel, merging their
+// messages into one subscription. HeaderChannel tells on which channel each
+// message was received. Canceling the subscription, or ctx being done, stops
+// all its consumers.
+//
+// If subscribing to any channel fails, consumers already created are stopped.
+func (c *Controller) SubscribeChannels(ctx context.Context, topic string, channels []string) (extensions.BrokerChannelSubscription, error) {
+	if len(channels) == 0 {
+		return extensions.BrokerChannelSubscription{}, errors.New("no channels to subscribe to")
+	}
+
+	topic = c.publishTopic(topic)
+	msgChan := make(chan extensions.BrokerMessage, c.bufferSize)
+	subs := make([]*subscription, 0, len(channels))
+	for _, channel := range channels {
+		s, err := c.subscribe(ctx, topic, channel, func(s *subscription) nsq.Handler {
+			return &messagesHandler{
+				controller:    c,
+				topic:         s.topic,
+				channel:       s.channel,
+				msgChan:       msgChan,
+				sub:           s,
+				channelHeader: true,
+			}
+		})
+		if err != nil {
+			c.stopSubscriptions(ctx, subs...)
+			c.unregister(subs...)
+			return extensions.BrokerChannelSubscription{}, fmt.Errorf("subscribing to channel %q: %w", channel, err)
+		}
+		subs = append(subs, s)
+	}
+
+	return newBrokerSubscription(ctx, msgChan, func() {
+		c.stopSubscriptions(ctx, subs...)
+		c.unregister(subs...)
+	}), nil
+}
@@ -0,0 +1,66 @@
+package nsq
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// clock tells the time and waits, so that tests can control both, see
+// withClock.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the default clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// randSource is the randomness behind retry jitter and ephemeral channel
+// names, so that tests can make them deterministic, see withRand.
+type randSource interface {
+	Int63n(n int64) int64
+	Uint32() uint32
+}
+
+// globalRand is the default randSource, the math/rand global one.
+type globalRand struct{}
+
+func (globalRand) Int63n(n int64) int64 { return rand.Int63n(n) }
+
+func (globalRand) Uint32() uint32 { return rand.Uint32() }
+
+// lockedRand makes a *rand.Rand safe for concurrent use.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (l *lockedRand) Int63n(n int64) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.r.Int63n(n)
+}
+
+func (l *lockedRand) Uint32() uint32 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.r.Uint32()
+}
+
+// withClock replaces the real clock used by retries, for tests.
+func withClock(clk clock) ControllerOption {
+	return func(controller *Controller) { controller.clock = clk }
+}
+
+// withRand replaces the randomness of retry jitter and ephemeral channel
+// names, for tests. r may be seeded to get the same values on every run.
+func withRand(r *rand.Rand) ControllerOption {
+	return func(controller *Controller) { controller.rand = &lockedRand{r: r} }
+}
@@ -0,0 +1,42 @@
+package nsq
+
+import (
+	"context"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestEphemeralChannelWithRand(t *testing.T) {
+	channel := func(seed int64) string {
+		c := newTestController(t, WithEphemeralChannel(), withRand(rand.New(rand.NewSource(seed))))
+
+		_, channel := c.subscriptionChannel("orders")
+		return channel
+	}
+
+	if first, second := channel(1), channel(1); first != second {
+		t.Errorf("ephemeral channels with the same seed = %q and %q, want them equal", first, second)
+	}
+	if first, second := channel(1), channel(2); first == second {
+		t.Errorf("ephemeral channels with different seeds = %q, want them different", first)
+	}
+}
+
+func TestReconnectWithClock(t *testing.T) {
+	clk := &instantClock{}
+	c := newTestController(t, WithReconnect(3, time.Minute), WithRetryJitter(JitterNone), withClock(clk))
+
+	start := time.Now()
+	if _, err := c.Subscribe(context.Background(), "orders"); err == nil {
+		t.Fatal("Subscribe() error = nil, want connection refused")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Subscribe() took %v, want no real wait between retries", elapsed)
+	}
+
+	if want := []time.Duration{time.Minute, maxRetryDelay, maxRetryDelay}; !slices.Equal(clk.delays, want) {
+		t.Errorf("waited %v, want %v", clk.delays, want)
+	}
+}
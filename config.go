@@ -0,0 +1,391 @@
+package nsq
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// tweakConfig returns a copy of base with tweaks applied. Tweaks are set by
+// options like WithTLSConfig and always win over a config passed with
+// WithProducerConfig or WithConsumerConfig, whatever the options order.
+func tweakConfig(base *nsq.Config, tweaks []func(cfg *nsq.Config)) *nsq.Config {
+	cfg := *base
+	for _, tweak := range tweaks {
+		tweak(&cfg)
+	}
+
+	// Backoff strategies read the config they're set with: bind it to the copy.
+	if cfg.BackoffStrategy != nil {
+		_ = cfg.Set("backoff_strategy", cfg.BackoffStrategy)
+	}
+
+	return &cfg
+}
+
+// validateConfig checks cfg values, including combinations go-nsq would only
+// refuse when connecting.
+func validateConfig(cfg *nsq.Config) error {
+	if cfg.HeartbeatInterval >= cfg.ReadTimeout {
+		return fmt.Errorf("heartbeat interval %v must be less than read timeout %v", cfg.HeartbeatInterval, cfg.ReadTimeout)
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.Snappy && cfg.Deflate {
+		return errors.New("snappy and deflate compressions can't be both enabled")
+	}
+
+	return nil
+}
+
+// withTweak applies tweak to both producer and consumer configs.
+func withTweak(tweak func(cfg *nsq.Config)) ControllerOption {
+	return func(controller *Controller) {
+		controller.producerTweaks = append(controller.producerTweaks, tweak)
+		controller.consumerTweaks = append(controller.consumerTweaks, tweak)
+	}
+}
+
+// withConsumerTweak applies tweak to consumer configs only.
+func withConsumerTweak(tweak func(cfg *nsq.Config)) ControllerOption {
+	return func(controller *Controller) {
+		controller.consumerTweaks = append(controller.consumerTweaks, tweak)
+	}
+}
+
+// withError makes NewController fail with err.
+func withError(err error) ControllerOption {
+	return func(controller *Controller) { controller.invalidOption(err) }
+}
+
+// WithTLSConfig enables TLS for connections to nsqd, and switches LookupTopics
+// to https using the same config. It can't be combined with WithHTTPClient,
+// whose transport must then carry the TLS config.
+func WithTLSConfig(tlsConfig *tls.Config) ControllerOption {
+	tweak := withTweak(func(cfg *nsq.Config) {
+		cfg.TlsV1 = true
+		cfg.TlsConfig = tlsConfig
+	})
+
+	return func(controller *Controller) {
+		tweak(controller)
+		controller.tlsConfig = tlsConfig
+	}
+}
+
+// WithMutualTLS is like WithTLSConfig, with a config presenting the client
+// certificate from certFile and keyFile, and trusting only the CA certificates
+// from caFile. Files are PEM encoded, and TLS 1.2 is required at least.
+//
+// Errors loading the files are returned by NewController.
+func WithMutualTLS(certFile, keyFile, caFile string) ControllerOption {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return withError(fmt.Errorf("loading client certificate: %w", err))
+	}
+
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return withError(fmt.Errorf("loading CA certificates: %w", err))
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return withError(fmt.Errorf("loading CA certificates: no certificate found in %s", caFile))
+	}
+
+	return WithTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	})
+}
+
+// WithAuthSecret sets the secret presented to nsqd configured with
+// --auth-http-address. The secret is never logged.
+func WithAuthSecret(secret string) ControllerOption {
+	return withTweak(func(cfg *nsq.Config) { cfg.AuthSecret = secret })
+}
+
+// WithAuthSecretFunc is like WithAuthSecret, but gets the secret from fn, so
+// it can rotate. Consumers get it every time Subscribe creates one, and keep it
+// for as long as they live, reconnections included. The producers get it once,
+// in NewController, and can't rotate it.
+//
+// Errors from fn make NewController or Subscribe fail.
+func WithAuthSecretFunc(fn func() (string, error)) ControllerOption {
+	return func(controller *Controller) { controller.authSecret = fn }
+}
+
+// authSecretConfig sets the secret from the WithAuthSecretFunc function on
+// cfg, if any.
+func (c *Controller) authSecretConfig(cfg *nsq.Config) error {
+	if c.authSecret == nil {
+		return nil
+	}
+
+	secret, err := c.authSecret()
+	if err != nil {
+		return fmt.Errorf("getting auth secret: %w", err)
+	}
+	cfg.AuthSecret = secret
+
+	return nil
+}
+
+// WithMaxAttempts sets how many times a message is delivered before NSQ gives
+// it up. Zero means no limit.
+func WithMaxAttempts(n uint16) ControllerOption {
+	return withConsumerTweak(func(cfg *nsq.Config) { cfg.MaxAttempts = n })
+}
+
+// WithSnappy enables Snappy compression of connections to nsqd. It can't be
+// used along with WithDeflate.
+func WithSnappy() ControllerOption {
+	return withTweak(func(cfg *nsq.Config) { cfg.Snappy = true })
+}
+
+// WithDeflate enables Deflate compression of connections to nsqd, level is
+// between 1 and 9. It can't be used along with WithSnappy.
+func WithDeflate(level int) ControllerOption {
+	return withTweak(func(cfg *nsq.Config) {
+		cfg.Deflate = true
+		cfg.DeflateLevel = level
+	})
+}
+
+// WithDialTimeout sets the timeout for connecting to nsqd, for both producer
+// and consumers. Defaults to go-nsq's 1 second.
+func WithDialTimeout(d time.Duration) ControllerOption {
+	return withDurationTweak("dial timeout", d, func(cfg *nsq.Config) { cfg.DialTimeout = d })
+}
+
+// WithReadTimeout sets the deadline for network reads from nsqd, for both
+// producer and consumers. Defaults to go-nsq's 60 seconds.
+func WithReadTimeout(d time.Duration) ControllerOption {
+	return withDurationTweak("read timeout", d, func(cfg *nsq.Config) { cfg.ReadTimeout = d })
+}
+
+// withDurationTweak applies tweak to both configs, unless d is negative.
+func withDurationTweak(name string, d time.Duration, tweak func(cfg *nsq.Config)) ControllerOption {
+	if d < 0 {
+		return withError(fmt.Errorf("invalid %s %v: must not be negative", name, d))
+	}
+
+	return withTweak(tweak)
+}
+
+// WithHeartbeatInterval sets how often nsqd sends heartbeats to consumers. It
+// must be less than the read timeout (see WithReadTimeout), otherwise
+// connections would be dropped between heartbeats.
+func WithHeartbeatInterval(d time.Duration) ControllerOption {
+	return withConsumerTweak(func(cfg *nsq.Config) { cfg.HeartbeatInterval = d })
+}
+
+// WithSampleRate makes nsqd deliver only pct percent of messages, between 0
+// (no sampling) and 99. Sampling is applied by nsqd per channel, so consumers
+// sharing a channel should agree on it.
+func WithSampleRate(pct int) ControllerOption {
+	if pct < 0 || pct > 99 {
+		return withError(fmt.Errorf("invalid sample rate %d: must be between 0 and 99", pct))
+	}
+
+	return withConsumerTweak(func(cfg *nsq.Config) { cfg.SampleRate = int32(pct) })
+}
+
+// WithIdentity sets the user agent and hostname sent to nsqd, shown by
+// nsqadmin for every client. Empty values keep go-nsq defaults.
+func WithIdentity(userAgent, hostname string) ControllerOption {
+	return withTweak(func(cfg *nsq.Config) {
+		if userAgent != "" {
+			cfg.UserAgent = userAgent
+		}
+		if hostname != "" {
+			cfg.Hostname = hostname
+		}
+	})
+}
+
+// WithClientID sets the client ID sent to nsqd, defaulting to the short
+// hostname. An empty id keeps the default.
+func WithClientID(id string) ControllerOption {
+	return withTweak(func(cfg *nsq.Config) {
+		if id != "" {
+			cfg.ClientID = id
+		}
+	})
+}
+
+// minMsgTimeout is the lowest message timeout nsqd accepts.
+const minMsgTimeout = time.Second
+
+// WithMsgTimeout sets how long nsqd waits for a message to be finished before
+// requeueing it, which should cover the slowest processing. It must be at
+// least 1 second, and nsqd refuses to connect consumers exceeding its
+// --max-msg-timeout (15 minutes by default).
+//
+// With WithAutoTouch, the touch interval must be less than d.
+func WithMsgTimeout(d time.Duration) ControllerOption {
+	if d < minMsgTimeout {
+		return withError(fmt.Errorf("invalid message timeout %v: must be at least %v", d, minMsgTimeout))
+	}
+
+	return withConsumerTweak(func(cfg *nsq.Config) { cfg.MsgTimeout = d })
+}
+
+// WithBackoff sets how consumers back off when handlers fail: they stop
+// receiving messages for multiplier times the backoff level, up to maxBackoff
+// (go-nsq's default strategy is exponential, see WithBackoffStrategy).
+// Defaults are go-nsq's 2 minutes max and 1 second multiplier.
+//
+// A zero maxBackoff disables backoff.
+func WithBackoff(maxBackoff, multiplier time.Duration) ControllerOption {
+	if maxBackoff < 0 || multiplier < 0 {
+		return withError(fmt.Errorf("invalid backoff %v, %v: must not be negative", maxBackoff, multiplier))
+	}
+
+	return withConsumerTweak(func(cfg *nsq.Config) {
+		cfg.MaxBackoffDuration = maxBackoff
+		cfg.BackoffMultiplier = multiplier
+	})
+}
+
+// WithBackoffStrategy sets how consumers compute backoff durations, defaulting
+// to go-nsq's nsq.ExponentialStrategy. newStrategy is called once per
+// consumer, as strategies such as nsq.FullJitterStrategy, which spreads
+// backoffs of consumers failing together, aren't safe for concurrent use.
+func WithBackoffStrategy(newStrategy func() nsq.BackoffStrategy) ControllerOption {
+	if newStrategy == nil {
+		return withError(errors.New("invalid backoff strategy: must not be nil"))
+	}
+
+	return func(controller *Controller) { controller.newBackoffStrategy = newStrategy }
+}
+
+// Bounds of the lookupd poll interval accepted by go-nsq.
+const (
+	minLookupdPollInterval = 10 * time.Millisecond
+	maxLookupdPollInterval = 5 * time.Minute
+)
+
+// WithLookupdPollInterval sets how often consumers query nsqlookupd for nsqd
+// producing their topic (see WithLookupdConnect), between 10 milliseconds and
+// 5 minutes. Defaults to go-nsq's 60 seconds. Without nsqlookupd, it's the
+// delay between reconnection attempts to nsqd.
+func WithLookupdPollInterval(d time.Duration) ControllerOption {
+	if d < minLookupdPollInterval || d > maxLookupdPollInterval {
+		return withError(fmt.Errorf("invalid lookupd poll interval %v: must be between %v and %v",
+			d, minLookupdPollInterval, maxLookupdPollInterval))
+	}
+
+	return withConsumerTweak(func(cfg *nsq.Config) { cfg.LookupdPollInterval = d })
+}
+
+// WithLookupdPollJitter sets the fraction of the poll interval, between 0 and
+// 1, randomly added to the first nsqlookupd query, so that consumers started
+// together don't query it at once. Defaults to go-nsq's 0.3.
+func WithLookupdPollJitter(f float64) ControllerOption {
+	if f < 0 || f > 1 {
+		return withError(fmt.Errorf("invalid lookupd poll jitter %v: must be between 0 and 1", f))
+	}
+
+	return withConsumerTweak(func(cfg *nsq.Config) { cfg.LookupdPollJitter = f })
+}
+
+// WithMaxRequeueDelay caps the delay of messages requeued after their handler
+// failed, see WithDefaultRequeueDelay. Defaults to go-nsq's 15 minutes, and
+// nsqd refuses delays over its --max-req-timeout (1 hour by default).
+func WithMaxRequeueDelay(d time.Duration) ControllerOption {
+	if d < 0 {
+		return withError(fmt.Errorf("invalid max requeue delay %v: must not be negative", d))
+	}
+
+	return withConsumerTweak(func(cfg *nsq.Config) { cfg.MaxRequeueDelay = d })
+}
+
+// WithDefaultRequeueDelay sets the delay of messages requeued after their
+// handler failed, multiplied by their attempts count and capped by
+// WithMaxRequeueDelay. Defaults to go-nsq's 90 seconds.
+//
+// The requeue delay postpones the failed message only, while backoff (see
+// WithBackoff) slows down the whole consumer.
+func WithDefaultRequeueDelay(d time.Duration) ControllerOption {
+	if d < 0 {
+		return withError(fmt.Errorf("invalid default requeue delay %v: must not be negative", d))
+	}
+
+	return withConsumerTweak(func(cfg *nsq.Config) { cfg.DefaultRequeueDelay = d })
+}
+
+// Bounds of the output buffer size nsqd accepts with its default
+// --max-output-buffer-size.
+const (
+	minOutputBufferSize = 64
+	maxOutputBufferSize = 64 * 1024
+)
+
+// WithOutputBufferSize sets how many bytes nsqd buffers before writing
+// messages to consumers, defaulting to go-nsq's 16 KiB. Larger buffers favor
+// throughput, smaller ones latency. It must be between 64 bytes and 64 KiB, or
+// -1 to disable buffering.
+func WithOutputBufferSize(n int64) ControllerOption {
+	if n != -1 && (n < minOutputBufferSize || n > maxOutputBufferSize) {
+		return withError(fmt.Errorf("invalid output buffer size %d: must be -1 or between %d and %d",
+			n, minOutputBufferSize, maxOutputBufferSize))
+	}
+
+	return withConsumerTweak(func(cfg *nsq.Config) { cfg.OutputBufferSize = n })
+}
+
+// WithOutputBufferTimeout sets how long nsqd buffers messages before writing
+// them to consumers, defaulting to go-nsq's 250 milliseconds. Short timeouts
+// lower latency, at the cost of nsqd CPU, and nsqd refuses timeouts below its
+// --min-output-buffer-timeout (25 milliseconds by default).
+func WithOutputBufferTimeout(d time.Duration) ControllerOption {
+	if d < 0 {
+		return withError(fmt.Errorf("invalid output buffer timeout %v: must not be negative", d))
+	}
+
+	return withConsumerTweak(func(cfg *nsq.Config) { cfg.OutputBufferTimeout = d })
+}
+
+// Bounds go-nsq accepts for RDY redistribution settings.
+const (
+	minLowRdyIdleTimeout       = time.Second
+	maxLowRdyIdleTimeout       = 5 * time.Minute
+	minRDYRedistributeInterval = time.Millisecond
+	maxRDYRedistributeInterval = 5 * time.Second
+)
+
+// WithLowRdyIdleTimeout sets how long a connection to nsqd may stay idle
+// before consumers take its RDY count back, to give it to busier ones, between
+// 1 second and 5 minutes. Defaults to go-nsq's 10 seconds.
+//
+// This matters when MaxInFlight is lower than the number of nsqd producing a
+// topic, such as with dozens of them discovered through nsqlookupd: some
+// connections then have no RDY and rely on redistribution to get messages.
+func WithLowRdyIdleTimeout(d time.Duration) ControllerOption {
+	if d < minLowRdyIdleTimeout || d > maxLowRdyIdleTimeout {
+		return withError(fmt.Errorf("invalid low rdy idle timeout %v: must be between %v and %v",
+			d, minLowRdyIdleTimeout, maxLowRdyIdleTimeout))
+	}
+
+	return withConsumerTweak(func(cfg *nsq.Config) { cfg.LowRdyIdleTimeout = d })
+}
+
+// WithRDYRedistributeInterval sets how often consumers redistribute RDY among
+// their nsqd connections, see WithLowRdyIdleTimeout, between 1 millisecond and
+// 5 seconds. Defaults to go-nsq's 5 seconds.
+func WithRDYRedistributeInterval(d time.Duration) ControllerOption {
+	if d < minRDYRedistributeInterval || d > maxRDYRedistributeInterval {
+		return withError(fmt.Errorf("invalid rdy redistribute interval %v: must be between %v and %v",
+			d, minRDYRedistributeInterval, maxRDYRedistributeInterval))
+	}
+
+	return withConsumerTweak(func(cfg *nsq.Config) { cfg.RDYRedistributeInterval = d })
+}
@@ -0,0 +1,47 @@
+package nsq
+
+import (
+	"testing"
+
+	"github.com/nsqio/go-nsq"
+)
+
+func TestCompression(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []ControllerOption
+		check   func(cfg *nsq.Config) bool
+	}{
+		{
+			name:    "snappy",
+			options: []ControllerOption{WithSnappy()},
+			check:   func(cfg *nsq.Config) bool { return cfg.Snappy && !cfg.Deflate },
+		},
+		{
+			name:    "deflate",
+			options: []ControllerOption{WithDeflate(6)},
+			check:   func(cfg *nsq.Config) bool { return cfg.Deflate && cfg.DeflateLevel == 6 && !cfg.Snappy },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestController(t, tt.options...)
+
+			if !tt.check(c.producerConfig) {
+				t.Errorf("producer config: snappy %v, deflate %v level %d",
+					c.producerConfig.Snappy, c.producerConfig.Deflate, c.producerConfig.DeflateLevel)
+			}
+			if !tt.check(c.consumerConfig) {
+				t.Errorf("consumer config: snappy %v, deflate %v level %d",
+					c.consumerConfig.Snappy, c.consumerConfig.Deflate, c.consumerConfig.DeflateLevel)
+			}
+		})
+	}
+}
+
+func TestCompressionConflict(t *testing.T) {
+	if _, err := NewController(testAddr, WithSnappy(), WithDeflate(6)); err == nil {
+		t.Error("NewController() with snappy and deflate succeeded, want an error")
+	}
+}
@@ -0,0 +1,62 @@
+package nsq
+
+import (
+	"errors"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// connectStep connects a consumer to nsqd or nsqlookupd.
+type connectStep func(consumer *nsq.Consumer) error
+
+// WithNSQDAddress makes consumers also connect directly to the nsqd at addrs
+// (e.g. "nsqd:4150"), besides the controller address.
+func WithNSQDAddress(addrs ...string) ControllerOption {
+	return func(controller *Controller) {
+		for _, addr := range addrs {
+			controller.connectSteps = append(controller.connectSteps, nsqdConnect(addr))
+		}
+	}
+}
+
+// WithLookupdAddress makes consumers also discover nsqd through the
+// nsqlookupd at addrs (e.g. "nsqlookupd:4161"), besides the controller
+// address. It can be combined with WithNSQDAddress.
+func WithLookupdAddress(addrs ...string) ControllerOption {
+	return func(controller *Controller) {
+		for _, addr := range addrs {
+			controller.connectSteps = append(controller.connectSteps, nsqlookupdConnect(addr))
+		}
+	}
+}
+
+// connectConsumer runs every connect step, joining their errors.
+func (c *Controller) connectConsumer(consumer *nsq.Consumer) error {
+	if len(c.connectSteps) == 0 {
+		return errors.New("no nsqd or nsqlookupd address to connect to")
+	}
+
+	var errs []error
+	for _, step := range c.connectSteps {
+		if err := step(consumer); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func nsqdConnect(addr string) connectStep {
+	return func(consumer *nsq.Consumer) error {
+		// Steps run again when retrying, see WithReconnect
+		if err := consumer.ConnectToNSQD(addr); err != nil && !errors.Is(err, nsq.ErrAlreadyConnected) {
+			return err
+		}
+
+		return nil
+	}
+}
+
+func nsqlookupdConnect(addr string) connectStep {
+	return func(consumer *nsq.Consumer) error { return consumer.ConnectToNSQLookupd(addr) }
+}
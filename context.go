@@ -0,0 +1,25 @@
+package nsq
+
+import (
+	"context"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+)
+
+// messageIDKey is the context key of the message ID, see MessageIDFromContext.
+type messageIDKey struct{}
+
+// MessageIDFromContext returns the NSQ message ID carried by the context of a
+// delivery (see Delivery.Context), as in HeaderMessageID. ok is false if ctx
+// has none.
+func MessageIDFromContext(ctx context.Context) (id string, ok bool) {
+	id, ok = ctx.Value(messageIDKey{}).(string)
+	return id, ok
+}
+
+// messageContext derives the context of a received message from ctx: it
+// carries what was propagated in bm headers (see ExtractContext) and the
+// message ID (see MessageIDFromContext).
+func (c *Controller) messageContext(ctx context.Context, id string, bm extensions.BrokerMessage) context.Context {
+	return context.WithValue(c.ExtractContext(ctx, bm), messageIDKey{}, id)
+}
@@ -0,0 +1,64 @@
+package nsq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+	"github.com/nsqio/go-nsq"
+)
+
+// HeaderDLQReason tells why a message was republished to the dead letter
+// topic, see WithDeadLetterTopic.
+const HeaderDLQReason = "X-DLQ-Reason"
+
+// deadLetterPublishTimeout bounds republishing a message to the dead letter
+// topic.
+const deadLetterPublishTimeout = 10 * time.Second
+
+// WithDeadLetterTopic republishes messages exceeding MaxAttempts (see
+// WithMaxAttempts) to topic instead of dropping them, with HeaderDLQReason
+// set. Headers, received ones included, are only kept with an envelope codec
+// (see WithEnvelopeCodec).
+//
+// Republishing uses the controller producers, and is best effort: failures
+// are logged. It happens after the WithDeadLetterHandler function, if any,
+// returns.
+func WithDeadLetterTopic(topic string) ControllerOption {
+	if err := validateName("dead letter topic", topic); err != nil {
+		return withError(err)
+	}
+
+	return func(controller *Controller) { controller.deadLetterTopic = topic }
+}
+
+// failMessage hands a message NSQ gives up to the dead letter handler and
+// topic, both getting it decoded as subscriptions do.
+func (c *Controller) failMessage(topic, channel string, message *nsq.Message) {
+	c.observeDelivery(topic, channel, message, DeliveryFailed)
+
+	bm, err := c.decode(message)
+	if err != nil {
+		// Still keep the message, as it was received
+		bm = c.brokerMessage(message)
+	}
+	bm.Headers[HeaderDLQReason] = []byte(fmt.Sprintf("exceeded max attempts (%d)", message.Attempts))
+
+	if c.deadLetter != nil {
+		c.deadLetter(bm)
+	}
+	if c.deadLetterTopic == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deadLetterPublishTimeout)
+	defer cancel()
+
+	if err := c.Publish(ctx, c.deadLetterTopic, bm); err != nil {
+		c.logger.Warning(ctx, "republishing message to dead letter topic failed",
+			extensions.LogInfo{Key: "topic", Value: c.deadLetterTopic},
+			extensions.LogInfo{Key: "message_id", Value: string(message.ID[:])},
+			extensions.LogInfo{Key: "error", Value: err.Error()})
+	}
+}
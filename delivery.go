@@ -0,0 +1,243 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+	"github.com/nsqio/go-nsq"
+)
+
+// Delivery is a received NSQ message, keeping its metadata typed. Unlike
+// messages received with Subscribe, handlers decide when and how it's
+// acknowledged, with Ack or Requeue.
+type Delivery struct {
+	// ID of the message given by nsqd, 16 hexadecimal characters.
+	ID string
+	// Attempts is how many times the message has been delivered.
+	Attempts uint16
+	// Timestamp is when nsqd received the message.
+	Timestamp time.Time
+	// NSQDAddress is the address of the nsqd that delivered the message.
+	NSQDAddress string
+	// Headers are set only with an envelope codec, see WithEnvelopeCodec.
+	Headers map[string][]byte
+	// Payload of the message.
+	Payload []byte
+
+	ctx     context.Context
+	message *nsq.Message
+	headers map[string][]byte // the same as received with Subscribe
+	handler *deliveryHandler
+}
+
+// Context returns the context of the message, derived from the
+// SubscribeDelivery one. It carries what was propagated in the message, such
+// as the publisher trace context (see ExtractContext), and the message ID (see
+// MessageIDFromContext).
+func (d *Delivery) Context() context.Context { return d.ctx }
+
+// Ack finishes the message.
+func (d *Delivery) Ack() {
+	d.message.Finish()
+	d.handler.observe(d.message, DeliveryFinished)
+}
+
+// Requeue requeues the message, delivering it again after delay. A negative
+// delay lets go-nsq compute it from the attempts count.
+func (d *Delivery) Requeue(delay time.Duration) { d.handler.requeue(d.message, delay) }
+
+// Touch resets the message timeout, see WithMsgTimeout.
+func (d *Delivery) Touch() { d.message.Touch() }
+
+// DeliverySubscription is a subscription created with SubscribeDelivery.
+type DeliverySubscription struct {
+	controller *Controller
+	sub        *subscription
+	deliveries chan *Delivery
+	cancelOnce sync.Once
+	stopWatch  func() bool // stops canceling when the subscribe context is done
+}
+
+// Deliveries returns the channel of received messages, closed once the
+// subscription is canceled.
+func (ds *DeliverySubscription) Deliveries() <-chan *Delivery { return ds.deliveries }
+
+// Cancel stops the subscription, waiting for its consumer to drain, or ctx to
+// be done. Deliveries not read yet are requeued.
+func (ds *DeliverySubscription) Cancel(ctx context.Context) {
+	ds.cancelOnce.Do(func() {
+		ds.stopWatch()
+		ds.sub.stopTransmitting()
+		close(ds.deliveries)
+		for d := range ds.deliveries {
+			d.message.RequeueWithoutBackoff(0)
+			d.handler.observe(d.message, DeliveryRequeued)
+		}
+
+		ds.controller.stopSubscriptions(ctx, ds.sub)
+		ds.controller.unregister(ds.sub)
+	})
+}
+
+// SubscribeDelivery subscribes to topic like Subscribe, but yields
+// deliveries, which must each be acknowledged with Ack or Requeue. The
+// subscription stops once canceled, or once ctx is done.
+//
+// It's not part of extensions.BrokerController: use it when handling messages
+// by hand rather than through generated code.
+func (c *Controller) SubscribeDelivery(ctx context.Context, topic string) (*DeliverySubscription, error) {
+	deliveries := make(chan *Delivery, c.bufferSize)
+	topic, channel := c.subscriptionChannel(topic)
+	s, err := c.subscribe(ctx, topic, channel, func(s *subscription) nsq.Handler {
+		return &deliveryHandler{controller: c, ctx: ctx, sub: s, deliveries: deliveries}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ds := &DeliverySubscription{controller: c, sub: s, deliveries: deliveries}
+	ds.stopWatch = context.AfterFunc(ctx, func() { ds.Cancel(context.Background()) })
+
+	return ds, nil
+}
+
+// deliveryHandler transmits messages received by a consumer to its
+// DeliverySubscription.
+type deliveryHandler struct {
+	controller *Controller
+	ctx        context.Context // of SubscribeDelivery, messages contexts derive from it
+	sub        *subscription
+	deliveries chan<- *Delivery
+}
+
+var _ nsq.FailedMessageLogger = (*deliveryHandler)(nil)
+
+// LogFailedMessage implements nsq.FailedMessageLogger, like for Subscribe.
+func (h *deliveryHandler) LogFailedMessage(message *nsq.Message) {
+	h.controller.failMessage(h.sub.topic, h.sub.channel, message)
+}
+
+// HandleMessage implements nsq.Handler.
+func (h *deliveryHandler) HandleMessage(message *nsq.Message) error {
+	message.DisableAutoResponse()
+	h.controller.metrics.IncReceived(h.sub.topic, h.sub.channel)
+	h.controller.stats.received.inc(topicChannel{h.sub.topic, h.sub.channel})
+
+	bm, err := h.controller.decode(message)
+	if err != nil {
+		h.requeue(message, -1)
+		return err
+	}
+
+	id := string(message.ID[:])
+	d := &Delivery{
+		ID:          id,
+		Attempts:    message.Attempts,
+		Timestamp:   time.Unix(0, message.Timestamp),
+		NSQDAddress: message.NSQDAddress,
+		Payload:     bm.Payload,
+		ctx:         h.controller.messageContext(h.ctx, id, bm),
+		message:     message,
+		headers:     bm.Headers,
+		handler:     h,
+	}
+	if h.controller.envelope != nil {
+		d.Headers = bm.Headers
+	}
+
+	h.sub.mu.RLock()
+	defer h.sub.mu.RUnlock()
+
+	select {
+	case <-h.sub.done:
+		h.requeue(message, -1)
+		return nil
+	default:
+	}
+
+	select {
+	case h.deliveries <- d:
+	case <-h.sub.done:
+		h.requeue(message, -1)
+	}
+
+	return nil
+}
+
+// Consume subscribes to topic and calls handler with every received message,
+// until ctx is done or the controller is closed. Returning nil from handler
+// acks the message, returning an error requeues it, after the delay of
+// RequeueAfter errors. Panics are recovered, see WithPanicPolicy. The handler
+// context derives from ctx, see Delivery.Context for the values it carries.
+//
+// It returns nil once ctx is done, ErrControllerClosed once the controller is
+// closed, or the error subscribing.
+func (c *Controller) Consume(ctx context.Context, topic string, handler func(context.Context, extensions.BrokerMessage) error) error {
+	ds, err := c.SubscribeDelivery(ctx, topic)
+	if err != nil {
+		return err
+	}
+	defer ds.Cancel(context.Background())
+
+	for {
+		select {
+		case d, ok := <-ds.Deliveries():
+			if !ok {
+				// Canceled as ctx is done
+				return nil
+			}
+
+			c.process(d, handler)
+		case <-ctx.Done():
+			return nil
+		case <-c.shutdown:
+			return ErrControllerClosed
+		}
+	}
+}
+
+// process calls handler with d, then acks or requeues it depending on the
+// returned error, see Consume.
+func (c *Controller) process(d *Delivery, handler func(context.Context, extensions.BrokerMessage) error) {
+	bm := extensions.BrokerMessage{Headers: d.headers, Payload: d.Payload}
+	var requeue *requeueError
+	switch err := c.handle(d, bm, handler); {
+	case err == nil:
+		d.Ack()
+	case errors.As(err, &requeue):
+		d.Requeue(requeue.delay)
+	default:
+		d.Requeue(-1)
+	}
+}
+
+// maxRequeueDelay is the default --max-req-timeout of nsqd, which refuses
+// longer requeue delays.
+const maxRequeueDelay = time.Hour
+
+// RequeueAfter returns an error making Consume, or Nack with WithManualAck,
+// requeue the message after d, rather than the delay go-nsq computes from its
+// attempts count. d is clamped between 0 and nsqd default max requeue delay of
+// 1 hour.
+func RequeueAfter(d time.Duration) error {
+	return &requeueError{delay: min(max(d, 0), maxRequeueDelay)}
+}
+
+type requeueError struct {
+	delay time.Duration
+}
+
+func (e *requeueError) Error() string { return fmt.Sprintf("requeue after %v", e.delay) }
+
+func (h *deliveryHandler) requeue(message *nsq.Message, delay time.Duration) {
+	message.Requeue(delay)
+	h.observe(message, DeliveryRequeued)
+}
+
+func (h *deliveryHandler) observe(message *nsq.Message, outcome DeliveryOutcome) {
+	h.controller.observeDelivery(h.sub.topic, h.sub.channel, message, outcome)
+}
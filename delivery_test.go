@@ -0,0 +1,80 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+	"github.com/nsqio/go-nsq"
+)
+
+// recordingDelegate records how messages are responded to.
+type recordingDelegate struct {
+	finished bool
+	requeued bool
+	delay    time.Duration
+}
+
+var _ nsq.MessageDelegate = (*recordingDelegate)(nil)
+
+func (d *recordingDelegate) OnFinish(*nsq.Message) { d.finished = true }
+
+func (d *recordingDelegate) OnRequeue(_ *nsq.Message, delay time.Duration, _ bool) {
+	d.requeued, d.delay = true, delay
+}
+
+func (d *recordingDelegate) OnTouch(*nsq.Message) {}
+
+// testDelivery returns a delivery of a subscription of c, and the delegate
+// its message is responded to.
+func testDelivery(c *Controller) (*Delivery, *recordingDelegate) {
+	message := newTestMessage("0a1b2c3d4e5f6789", []byte("hello"))
+	delegate := &recordingDelegate{}
+	message.Delegate = delegate
+	message.DisableAutoResponse()
+
+	return &Delivery{
+		ID:      string(message.ID[:]),
+		Payload: message.Body,
+		ctx:     context.Background(),
+		message: message,
+		handler: &deliveryHandler{
+			controller: c,
+			sub:        &subscription{topic: "orders", channel: defaultChannelName},
+		},
+	}, delegate
+}
+
+func TestProcessRequeueAfter(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		wantFinished bool
+		wantDelay    time.Duration
+	}{
+		{name: "success", wantFinished: true},
+		{name: "error", err: errors.New("failed"), wantDelay: -1},
+		{name: "requeue after", err: RequeueAfter(30 * time.Second), wantDelay: 30 * time.Second},
+		{name: "wrapped requeue after", err: fmt.Errorf("failed: %w", RequeueAfter(time.Minute)), wantDelay: time.Minute},
+		{name: "requeue after clamped", err: RequeueAfter(2 * time.Hour), wantDelay: maxRequeueDelay},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestController(t)
+			d, delegate := testDelivery(c)
+
+			c.process(d, func(context.Context, extensions.BrokerMessage) error { return tt.err })
+
+			if delegate.finished != tt.wantFinished || delegate.requeued == tt.wantFinished {
+				t.Fatalf("finished %v, requeued %v, want finished %v", delegate.finished, delegate.requeued, tt.wantFinished)
+			}
+			if delegate.delay != tt.wantDelay {
+				t.Errorf("requeue delay = %v, want %v", delegate.delay, tt.wantDelay)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package nsq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+)
+
+// EnvelopeCodec encodes broker messages, headers included, into NSQ message
+// bodies, as NSQ has no native headers.
+type EnvelopeCodec interface {
+	Encode(bm extensions.BrokerMessage) ([]byte, error)
+	Decode(body []byte) (extensions.BrokerMessage, error)
+}
+
+// Every envelope starts with a preamble made of envelopeMagic, a format byte
+// and a version byte. 0xff never starts valid UTF-8, so raw text or JSON
+// bodies are never mistaken for envelopes.
+const (
+	envelopeMagic        = "\xffNE"
+	envelopePreambleSize = len(envelopeMagic) + 2
+
+	envelopeFormatJSON   byte = 'J'
+	envelopeFormatBinary byte = 'B'
+
+	envelopeVersion1 byte = 1
+	// envelopeVersion2 adds a flags byte to the preamble.
+	envelopeVersion2 byte = 2
+
+	// envelopeFlagGzip means what follows the preamble is gzipped.
+	envelopeFlagGzip byte = 1 << 0
+
+	// maxDecompressedEnvelopeSize bounds gzipped envelopes once decompressed.
+	maxDecompressedEnvelopeSize = 64 << 20
+)
+
+var (
+	// ErrInvalidEnvelope is returned when decoding a body that isn't an envelope
+	// of the expected format.
+	ErrInvalidEnvelope = errors.New("invalid envelope")
+
+	// ErrUnsupportedEnvelopeVersion is returned when decoding an envelope
+	// written by a newer version of this package.
+	ErrUnsupportedEnvelopeVersion = errors.New("unsupported envelope version")
+)
+
+// WithEnvelopeCodec makes Publish wrap headers and payload into an envelope
+// and subscriptions unwrap it. Every producer and consumer of a topic must
+// agree on the codec: without this option bodies are raw payloads.
+func WithEnvelopeCodec(codec EnvelopeCodec) ControllerOption {
+	return func(controller *Controller) { controller.envelope = codec }
+}
+
+// WithEnvelopeAutoDetect makes subscriptions accept raw payloads along with
+// envelopes, to migrate producers of a topic to WithEnvelopeCodec one at a
+// time. Bodies starting with the envelope magic bytes 0xff 'N' 'E' are decoded
+// with the codec, others are raw payloads with no headers but the NSQ ones.
+//
+// It needs an envelope codec: NewController returns ErrEnvelopeRequired
+// otherwise.
+func WithEnvelopeAutoDetect() ControllerOption {
+	return func(controller *Controller) { controller.envelopeAutoDetect = true }
+}
+
+// isEnvelope tells whether body starts with the envelope magic bytes.
+func isEnvelope(body []byte) bool {
+	return bytes.HasPrefix(body, []byte(envelopeMagic))
+}
+
+// JSONEnvelope is an EnvelopeCodec writing headers and payload as a JSON
+// object, after the envelope preamble. Values are base64 encoded.
+type JSONEnvelope struct {
+	// CompressAbove gzips envelopes larger than this many bytes, when
+	// positive. Compressed envelopes can't be decoded by versions of this
+	// package before compression was supported.
+	CompressAbove int
+}
+
+var _ EnvelopeCodec = JSONEnvelope{}
+
+type jsonEnvelope struct {
+	Headers map[string][]byte `json:"headers,omitempty"`
+	Payload []byte            `json:"payload"`
+}
+
+// Encode implements EnvelopeCodec.
+func (e JSONEnvelope) Encode(bm extensions.BrokerMessage) ([]byte, error) {
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(jsonEnvelope{Headers: bm.Headers, Payload: bm.Payload}); err != nil {
+		return nil, fmt.Errorf("encoding json envelope: %w", err)
+	}
+
+	return seal(envelopeFormatJSON, b.Bytes(), e.CompressAbove)
+}
+
+// Decode implements EnvelopeCodec.
+func (JSONEnvelope) Decode(body []byte) (extensions.BrokerMessage, error) {
+	body, err := unseal(body, envelopeFormatJSON)
+	if err != nil {
+		return extensions.BrokerMessage{}, err
+	}
+
+	var e jsonEnvelope
+	if err := json.Unmarshal(body, &e); err != nil {
+		return extensions.BrokerMessage{}, fmt.Errorf("%w: %w", ErrInvalidEnvelope, err)
+	}
+
+	return extensions.BrokerMessage{Headers: e.Headers, Payload: e.Payload}, nil
+}
+
+// BinaryEnvelope is an EnvelopeCodec writing, after the envelope preamble, the
+// headers count then each key and value, all prefixed by their uvarint
+// length. The payload takes the rest of the body.
+type BinaryEnvelope struct {
+	// CompressAbove gzips envelopes larger than this many bytes, when
+	// positive. Compressed envelopes can't be decoded by versions of this
+	// package before compression was supported.
+	CompressAbove int
+}
+
+var _ EnvelopeCodec = BinaryEnvelope{}
+
+// Encode implements EnvelopeCodec.
+func (e BinaryEnvelope) Encode(bm extensions.BrokerMessage) ([]byte, error) {
+	b := binary.AppendUvarint(nil, uint64(len(bm.Headers)))
+	for k, v := range bm.Headers {
+		b = binary.AppendUvarint(b, uint64(len(k)))
+		b = append(b, k...)
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		b = append(b, v...)
+	}
+
+	return seal(envelopeFormatBinary, append(b, bm.Payload...), e.CompressAbove)
+}
+
+// Decode implements EnvelopeCodec.
+func (BinaryEnvelope) Decode(body []byte) (extensions.BrokerMessage, error) {
+	body, err := unseal(body, envelopeFormatBinary)
+	if err != nil {
+		return extensions.BrokerMessage{}, err
+	}
+
+	r := bytes.NewReader(body)
+	readBytes := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			return nil, fmt.Errorf("%w: truncated headers", ErrInvalidEnvelope)
+		}
+
+		b := make([]byte, n)
+		_, _ = r.Read(b)
+		return b, nil
+	}
+
+	count, err := binary.ReadUvarint(r)
+	if err != nil || count > uint64(r.Len()) {
+		return extensions.BrokerMessage{}, fmt.Errorf("%w: truncated headers", ErrInvalidEnvelope)
+	}
+
+	headers := make(map[string][]byte, count)
+	for i := uint64(0); i < count; i++ {
+		k, err := readBytes()
+		if err != nil {
+			return extensions.BrokerMessage{}, err
+		}
+		v, err := readBytes()
+		if err != nil {
+			return extensions.BrokerMessage{}, err
+		}
+		headers[string(k)] = v
+	}
+
+	return extensions.BrokerMessage{Headers: headers, Payload: body[len(body)-r.Len():]}, nil
+}
+
+// seal prepends the envelope preamble to content. Content larger than
+// compressAbove, if positive, is gzipped in a version 2 envelope, otherwise
+// version 1 is kept for compatibility.
+func seal(format byte, content []byte, compressAbove int) ([]byte, error) {
+	if compressAbove <= 0 || len(content) <= compressAbove {
+		return append([]byte{envelopeMagic[0], envelopeMagic[1], envelopeMagic[2], format, envelopeVersion1}, content...), nil
+	}
+
+	b := bytes.NewBuffer([]byte{envelopeMagic[0], envelopeMagic[1], envelopeMagic[2], format, envelopeVersion2, envelopeFlagGzip})
+	w := gzip.NewWriter(b)
+	if _, err := w.Write(content); err != nil {
+		return nil, fmt.Errorf("compressing envelope: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("compressing envelope: %w", err)
+	}
+
+	return b.Bytes(), nil
+}
+
+// unseal checks the envelope preamble and returns what follows it,
+// decompressed.
+func unseal(body []byte, format byte) ([]byte, error) {
+	if len(body) < envelopePreambleSize || string(body[:len(envelopeMagic)]) != envelopeMagic {
+		return nil, fmt.Errorf("%w: missing preamble", ErrInvalidEnvelope)
+	}
+	if f := body[len(envelopeMagic)]; f != format {
+		return nil, fmt.Errorf("%w: unexpected format %q", ErrInvalidEnvelope, f)
+	}
+
+	switch v := body[len(envelopeMagic)+1]; v {
+	case envelopeVersion1:
+		return body[envelopePreambleSize:], nil
+	case envelopeVersion2:
+		if len(body) == envelopePreambleSize {
+			return nil, fmt.Errorf("%w: missing flags", ErrInvalidEnvelope)
+		}
+		flags, content := body[envelopePreambleSize], body[envelopePreambleSize+1:]
+		if flags&^envelopeFlagGzip != 0 {
+			return nil, fmt.Errorf("%w: flags %#x", ErrUnsupportedEnvelopeVersion, flags)
+		}
+		if flags&envelopeFlagGzip == 0 {
+			return content, nil
+		}
+
+		return gunzip(content)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedEnvelopeVersion, v)
+	}
+}
+
+func gunzip(content []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidEnvelope, err)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(r, maxDecompressedEnvelopeSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidEnvelope, err)
+	}
+	if len(b) > maxDecompressedEnvelopeSize {
+		return nil, fmt.Errorf("%w: more than %d bytes decompressed", ErrInvalidEnvelope, maxDecompressedEnvelopeSize)
+	}
+
+	return b, nil
+}
@@ -0,0 +1,70 @@
+package nsq
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+)
+
+func TestEnvelopeAutoDetect(t *testing.T) {
+	encoded, err := JSONEnvelope{}.Encode(extensions.BrokerMessage{
+		Headers: map[string][]byte{"X-Custom": []byte("value")},
+		Payload: []byte(`{"id":1}`),
+	})
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		options     []ControllerOption
+		body        []byte
+		wantPayload []byte
+		wantHeader  bool
+		wantErr     bool
+	}{
+		{
+			name:        "raw body",
+			options:     []ControllerOption{WithEnvelopeAutoDetect()},
+			body:        []byte(`{"id":1}`),
+			wantPayload: []byte(`{"id":1}`),
+		},
+		{
+			name:        "envelope",
+			options:     []ControllerOption{WithEnvelopeAutoDetect()},
+			body:        encoded,
+			wantPayload: []byte(`{"id":1}`),
+			wantHeader:  true,
+		},
+		{
+			name:    "raw body without auto detect",
+			body:    []byte(`{"id":1}`),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestController(t, append(tt.options, WithEnvelopeCodec(JSONEnvelope{}))...)
+
+			bm, err := c.decode(newTestMessage("0a1b2c3d4e5f6789", tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decode() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if !bytes.Equal(bm.Payload, tt.wantPayload) {
+				t.Errorf("Payload = %q, want %q", bm.Payload, tt.wantPayload)
+			}
+			if _, ok := bm.Headers["X-Custom"]; ok != tt.wantHeader {
+				t.Errorf("X-Custom header set %v, want %v", ok, tt.wantHeader)
+			}
+			if got := string(bm.Headers[HeaderMessageID]); got != "0a1b2c3d4e5f6789" {
+				t.Errorf("%s = %q, want %q", HeaderMessageID, got, "0a1b2c3d4e5f6789")
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// Publishing errors are classified into the following, so callers can decide
+// with errors.Is whether to retry. The underlying error stays wrapped for
+// details.
+var (
+	// ErrNotConnected means nsqd couldn't be reached: dialing failed, the
+	// connection was lost before nsqd answered, or the producer was stopped.
+	ErrNotConnected = errors.New("nsqd not connected")
+	// ErrPublishTimeout means nsqd didn't answer in time: the publish context
+	// deadline was exceeded, or a network operation timed out.
+	ErrPublishTimeout = errors.New("publish timed out")
+	// ErrPublishRejected means nsqd refused the message, e.g. for an invalid
+	// topic or a message too large. Retrying won't help.
+	ErrPublishRejected = errors.New("publish rejected by nsqd")
+)
+
+// retryablePublishError tells whether publishing again may succeed, see
+// WithPublishRetry.
+func retryablePublishError(err error) bool {
+	return errors.Is(err, ErrNotConnected) ||
+		// Not when the publish context deadline was exceeded, it stays so
+		errors.Is(err, ErrPublishTimeout) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// classifyPublishError wraps err into the publishing error matching it, if
+// any.
+func classifyPublishError(err error) error {
+	var (
+		netErr      net.Error
+		protocolErr nsq.ErrProtocol
+	)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrPublishTimeout), errors.Is(err, ErrNotConnected), errors.Is(err, ErrPublishRejected):
+		// Already classified
+		return err
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return fmt.Errorf("%w: %w", ErrPublishTimeout, err)
+	case errors.Is(err, nsq.ErrNotConnected),
+		errors.Is(err, nsq.ErrStopped),
+		errors.As(err, &netErr):
+		return fmt.Errorf("%w: %w", ErrNotConnected, err)
+	case errors.As(err, &protocolErr):
+		return fmt.Errorf("%w: %w", ErrPublishRejected, err)
+	default:
+		return err
+	}
+}
+
+// ErrMessageTooLarge is returned when publishing a message larger than the
+// size set with WithMaxMessageSize, before sending it.
+var ErrMessageTooLarge = errors.New("message too large")
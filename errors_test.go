@@ -0,0 +1,42 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+	"github.com/nsqio/go-nsq"
+)
+
+func TestPublishNotConnected(t *testing.T) {
+	c := newTestController(t)
+	c.producers[0].Stop()
+
+	err := c.Publish(context.Background(), "orders", extensions.BrokerMessage{Payload: []byte("hello")})
+	if !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Publish() error = %v, want %v", err, ErrNotConnected)
+	}
+}
+
+func TestClassifyPublishError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "stopped", err: nsq.ErrStopped, want: ErrNotConnected},
+		{name: "not connected", err: nsq.ErrNotConnected, want: ErrNotConnected},
+		{name: "deadline exceeded", err: context.DeadlineExceeded, want: ErrPublishTimeout},
+		{name: "rejected", err: nsq.ErrProtocol{Reason: "E_BAD_TOPIC"}, want: ErrPublishRejected},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyPublishError(tt.err)
+			if !errors.Is(err, tt.want) || !errors.Is(err, tt.err) {
+				t.Errorf("classifyPublishError(%v) = %v, want %v wrapping it", tt.err, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package nsq
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeCommand is a command received by fakeNSQD.
+type fakeCommand struct {
+	name   string
+	params []string
+	body   []byte
+}
+
+// fakeNSQD speaks enough of the nsqd TCP protocol for producers: it answers
+// OK to every command, and records publications.
+type fakeNSQD struct {
+	mu       sync.Mutex
+	commands []fakeCommand
+}
+
+// newFakeNSQD starts a fakeNSQD, stopped once the test ends.
+func newFakeNSQD(t *testing.T) (addr string, nsqd *fakeNSQD) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	nsqd = &fakeNSQD{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go nsqd.serve(conn)
+		}
+	}()
+
+	return l.Addr().String(), nsqd
+}
+
+// published returns the commands publishing messages received so far.
+func (n *fakeNSQD) published() []fakeCommand {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var published []fakeCommand
+	for _, cmd := range n.commands {
+		switch cmd.name {
+		case "PUB", "MPUB", "DPUB":
+			published = append(published, cmd)
+		}
+	}
+
+	return published
+}
+
+func (n *fakeNSQD) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	if _, err := io.ReadFull(r, make([]byte, 4)); err != nil {
+		return
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		cmd := fakeCommand{name: fields[0], params: fields[1:]}
+		switch cmd.name {
+		case "NOP":
+			continue
+		case "CLS":
+			writeFrame(conn, "CLOSE_WAIT")
+			return
+		case "IDENTIFY", "PUB", "MPUB", "DPUB":
+			var size int32
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return
+			}
+			cmd.body = make([]byte, size)
+			if _, err := io.ReadFull(r, cmd.body); err != nil {
+				return
+			}
+		}
+
+		n.mu.Lock()
+		n.commands = append(n.commands, cmd)
+		n.mu.Unlock()
+		writeFrame(conn, "OK")
+	}
+}
+
+// writeFrame writes a response frame holding data.
+func writeFrame(w io.Writer, data string) {
+	frame := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(4+len(data)))
+	// Frame type 0 is a response
+	frame = append(frame, data...)
+	_, _ = w.Write(frame)
+}
+
+// mpubBodies splits the body of an MPUB command into its messages.
+func mpubBodies(body []byte) [][]byte {
+	n := binary.BigEndian.Uint32(body)
+	body = body[4:]
+
+	bodies := make([][]byte, 0, n)
+	for i := uint32(0); i < n; i++ {
+		size := binary.BigEndian.Uint32(body)
+		bodies = append(bodies, body[4:4+size])
+		body = body[4+size:]
+	}
+
+	return bodies
+}
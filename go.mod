@@ -5,6 +5,10 @@ go 1.21.5
 require (
 	github.com/lerenn/asyncapi-codegen v0.30.2
 	github.com/nsqio/go-nsq v1.1.0
+	go.opentelemetry.io/otel v1.24.0
+	go.opentelemetry.io/otel/trace v1.24.0
+	go.uber.org/goleak v1.3.0
+	golang.org/x/sync v0.6.0
 )
 
 require github.com/golang/snappy v0.0.1 // indirect
@@ -0,0 +1,230 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+	"github.com/nsqio/go-nsq"
+)
+
+// messagesHandler transmits messages received by a consumer to its
+// subscription.
+type messagesHandler struct {
+	controller *Controller
+	topic      string
+	channel    string
+	msgChan    chan<- extensions.BrokerMessage
+	sub        *subscription
+
+	// channelHeader sets HeaderChannel on messages, see SubscribeChannels.
+	channelHeader bool
+}
+
+var _ nsq.FailedMessageLogger = (*messagesHandler)(nil)
+
+// HandleMessage implements nsq.Handler. go-nsq finishes the message when nil is
+// returned, and requeues it otherwise. In manual ack mode, the message is
+// responded to once acknowledged instead, see waitAck.
+func (h *messagesHandler) HandleMessage(message *nsq.Message) error {
+	received := time.Now()
+	h.controller.metrics.IncReceived(h.topic, h.channel)
+	h.controller.stats.received.inc(topicChannel{h.topic, h.channel})
+
+	bm, err := h.controller.decode(message)
+	if err != nil {
+		h.observe(message, err)
+		return err
+	}
+	if h.channelHeader {
+		bm.Headers[HeaderChannel] = []byte(h.channel)
+	}
+
+	stopTouch := func() {}
+	if h.controller.autoTouch > 0 {
+		stopTouch = touchUntilDone(message, h.controller.autoTouch)
+	}
+	end := h.controller.traceReceive(h.topic, h.channel, message.Attempts, bm)
+	// Called once the message is responded to
+	done := func(err error) {
+		end(err)
+		h.controller.metrics.ObserveHandlerDuration(h.topic, time.Since(received))
+		stopTouch()
+		h.observe(message, err)
+	}
+
+	if !h.controller.manualAck {
+		err := h.transmit(bm)
+		done(err)
+		return err
+	}
+
+	id, ack := h.controller.awaitAck()
+	bm.Headers[HeaderDeliveryID] = []byte(id)
+	if err := h.transmit(bm); err != nil {
+		h.controller.forgetAck(id)
+		done(err)
+		return err
+	}
+
+	// Waiting for the acknowledgement here would hold the handler: at most
+	// WithConcurrentHandlers messages could then await one, rather than
+	// MaxInFlight.
+	message.DisableAutoResponse()
+	go func() {
+		err := h.waitAck(message, id, ack, received)
+		h.respond(message, err)
+		done(err)
+	}()
+
+	return nil
+}
+
+// waitAck waits for the acknowledgement of message, transmitted with the
+// given delivery id after being received at the given time.
+//
+// It returns an error making the message requeued when the subscription is
+// canceled or the controller shuts down before the message is acknowledged,
+// or it isn't acknowledged before its timeout.
+func (h *messagesHandler) waitAck(message *nsq.Message, id string, ack <-chan error, received time.Time) error {
+	// Past the message timeout, nsqd requeues the message anyway, so there is
+	// no point waiting longer. Its clock started when it was received, not
+	// once it left the subscription buffer.
+	var timeout <-chan time.Time
+	if d := h.controller.ackTimeout(); d > 0 {
+		timer := time.NewTimer(d - time.Since(received))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case err := <-ack:
+		return err
+	case <-timeout:
+		h.controller.forgetAck(id)
+		h.controller.logger.Warning(context.Background(), "message not acknowledged before its timeout",
+			extensions.LogInfo{Key: "topic", Value: h.topic},
+			extensions.LogInfo{Key: "channel", Value: h.channel},
+			extensions.LogInfo{Key: "message_id", Value: string(message.ID[:])})
+		return ErrAckTimeout
+	case <-h.sub.done:
+		h.controller.forgetAck(id)
+		return extensions.ErrSubscriptionCanceled
+	case <-h.controller.shutdown:
+		h.controller.forgetAck(id)
+		return ErrControllerClosed
+	}
+}
+
+// respond finishes message when err is nil, and requeues it otherwise, after
+// the delay of RequeueAfter errors.
+func (h *messagesHandler) respond(message *nsq.Message, err error) {
+	var requeue *requeueError
+	switch {
+	case err == nil:
+		message.Finish()
+	case errors.As(err, &requeue):
+		message.Requeue(requeue.delay)
+	default:
+		message.Requeue(-1)
+	}
+}
+
+// observe reports the outcome of message, requeued if err isn't nil.
+func (h *messagesHandler) observe(message *nsq.Message, err error) {
+	outcome := DeliveryFinished
+	if err != nil {
+		outcome = DeliveryRequeued
+	}
+	h.controller.observeDelivery(h.topic, h.channel, message, outcome)
+}
+
+// transmit sends bm to the subscription, unless it's canceled or the
+// controller shuts down first. As msgChan is closed once the subscription
+// stops, sending happens while holding sub.mu for reading.
+func (h *messagesHandler) transmit(bm extensions.BrokerMessage) error {
+	h.sub.mu.RLock()
+	defer h.sub.mu.RUnlock()
+
+	select {
+	case <-h.sub.done:
+		return extensions.ErrSubscriptionCanceled
+	default:
+	}
+
+	select {
+	case h.msgChan <- bm:
+		return nil
+	case <-h.sub.done:
+		return extensions.ErrSubscriptionCanceled
+	case <-h.controller.shutdown:
+		return ErrControllerClosed
+	}
+}
+
+// touchUntilDone touches message every interval until the returned function
+// is called.
+func touchUntilDone(message *nsq.Message, interval time.Duration) (done func()) {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				message.Touch()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() { close(stop) }
+}
+
+// LogFailedMessage implements nsq.FailedMessageLogger, go-nsq calls it right
+// before giving up a message that exceeded MaxAttempts.
+func (h *messagesHandler) LogFailedMessage(message *nsq.Message) {
+	h.controller.failMessage(h.topic, h.channel, message)
+}
+
+// decode turns an NSQ message into a broker message, unwrapping its envelope
+// if a codec is set, and the body is one with WithEnvelopeAutoDetect. NSQ
+// headers override the envelope ones.
+func (c *Controller) decode(message *nsq.Message) (extensions.BrokerMessage, error) {
+	bm := c.brokerMessage(message)
+	if c.envelope == nil || (c.envelopeAutoDetect && !isEnvelope(message.Body)) {
+		return bm, nil
+	}
+
+	decoded, err := c.envelope.Decode(message.Body)
+	if err != nil {
+		return extensions.BrokerMessage{}, err
+	}
+	if decoded.Headers == nil {
+		decoded.Headers = make(map[string][]byte, len(bm.Headers))
+	}
+	for k, v := range bm.Headers {
+		decoded.Headers[k] = v
+	}
+
+	return decoded, nil
+}
+
+func (c *Controller) brokerMessage(message *nsq.Message) extensions.BrokerMessage {
+	headers := map[string][]byte{
+		// NSQ IDs are already 16 hex ASCII characters, going through string
+		// copies it, so the header doesn't alias the message.
+		HeaderMessageID: []byte(string(message.ID[:])),
+		HeaderAttempts:  []byte(strconv.FormatUint(uint64(message.Attempts), 10)),
+		HeaderTimestamp: []byte(strconv.FormatInt(message.Timestamp, 10)),
+	}
+	if c.sourceAddressHeader {
+		headers[HeaderNSQDAddress] = []byte(message.NSQDAddress)
+	}
+
+	return extensions.BrokerMessage{Headers: headers, Payload: message.Body}
+}
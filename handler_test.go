@@ -0,0 +1,131 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+	"github.com/nsqio/go-nsq"
+)
+
+// testSubscription subscribes like Subscribe does, with a buffer of
+// bufferSize messages, also returning the handler of the consumer.
+func testSubscription(t *testing.T, c *Controller, bufferSize int) (extensions.BrokerChannelSubscription, *messagesHandler) {
+	t.Helper()
+
+	ctx := context.Background()
+	msgChan := make(chan extensions.BrokerMessage, bufferSize)
+	var h *messagesHandler
+	s, err := c.subscribe(ctx, "orders", defaultChannelName, func(s *subscription) nsq.Handler {
+		h = &messagesHandler{controller: c, topic: s.topic, channel: s.channel, msgChan: msgChan, sub: s}
+		return h
+	})
+	if err != nil {
+		t.Fatalf("subscribe() error = %v", err)
+	}
+
+	return newBrokerSubscription(ctx, msgChan, func() {
+		c.stopSubscriptions(ctx, s)
+		c.unregister(s)
+	}), h
+}
+
+func TestCancelWithFullBuffer(t *testing.T) {
+	c := newTestController(t, WithLazyConnect())
+	sub, h := testSubscription(t, c, 1)
+
+	if err := h.HandleMessage(newTestMessage("0000000000000001", []byte("first"))); err != nil {
+		t.Fatalf("HandleMessage() error = %v", err)
+	}
+
+	blocked := make(chan error, 1)
+	go func() { blocked <- h.HandleMessage(newTestMessage("0000000000000002", []byte("second"))) }()
+	select {
+	case err := <-blocked:
+		t.Fatalf("HandleMessage() with a full buffer returned %v, want it to block", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	sub.Cancel(context.Background())
+
+	select {
+	case err := <-blocked:
+		if !errors.Is(err, extensions.ErrSubscriptionCanceled) {
+			t.Errorf("blocked HandleMessage() error = %v, want %v", err, extensions.ErrSubscriptionCanceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandleMessage() still blocked after the subscription was canceled")
+	}
+
+	// msgChan is closed by now, so sending would panic
+	err := h.HandleMessage(newTestMessage("0000000000000003", []byte("third")))
+	if !errors.Is(err, extensions.ErrSubscriptionCanceled) {
+		t.Errorf("HandleMessage() after cancel error = %v, want %v", err, extensions.ErrSubscriptionCanceled)
+	}
+}
+
+// ackDelegate reports messages as they're finished or requeued.
+type ackDelegate struct {
+	finished chan *nsq.Message
+	requeued chan *nsq.Message
+}
+
+var _ nsq.MessageDelegate = (*ackDelegate)(nil)
+
+func (d *ackDelegate) OnFinish(m *nsq.Message) { d.finished <- m }
+
+func (d *ackDelegate) OnRequeue(m *nsq.Message, _ time.Duration, _ bool) { d.requeued <- m }
+
+func (d *ackDelegate) OnTouch(*nsq.Message) {}
+
+func TestManualAckSeveralPending(t *testing.T) {
+	c := newTestController(t, WithLazyConnect(), WithManualAck())
+	sub, h := testSubscription(t, c, 8)
+
+	delegate := &ackDelegate{finished: make(chan *nsq.Message, 2), requeued: make(chan *nsq.Message, 2)}
+	first, second := newTestMessage("0000000000000001", []byte("first")), newTestMessage("0000000000000002", []byte("second"))
+	first.Delegate, second.Delegate = delegate, delegate
+
+	// A single handler, the default, mustn't wait for acknowledgements
+	handled := make(chan error, 1)
+	go func() { handled <- errors.Join(h.HandleMessage(first), h.HandleMessage(second)) }()
+	select {
+	case err := <-handled:
+		if err != nil {
+			t.Fatalf("HandleMessage() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandleMessage() waited for an acknowledgement")
+	}
+
+	received := make([]extensions.BrokerMessage, 2)
+	for i := range received {
+		received[i] = <-sub.MessagesChannel()
+	}
+	if err := c.Ack(received[1]); err != nil {
+		t.Fatalf("Ack() error = %v", err)
+	}
+	if err := c.Nack(received[0], errors.New("failed")); err != nil {
+		t.Fatalf("Nack() error = %v", err)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		responses chan *nsq.Message
+		want      *nsq.Message
+	}{
+		{name: "finished", responses: delegate.finished, want: second},
+		{name: "requeued", responses: delegate.requeued, want: first},
+	} {
+		select {
+		case m := <-tt.responses:
+			if m != tt.want {
+				t.Errorf("%s message %s, want %s", tt.name, m.ID[:], tt.want.ID[:])
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("no message %s", tt.name)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package nsq
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+)
+
+// Headers set on every received message, from NSQ message metadata.
+const (
+	// HeaderMessageID is the NSQ message ID, 16 hexadecimal characters.
+	HeaderMessageID = "X-MsgID"
+	// HeaderAttempts is how many times the message has been delivered, as
+	// decimal ASCII. See ParseAttempts.
+	HeaderAttempts = "X-Attempts"
+	// HeaderTimestamp is when nsqd received the message, as decimal ASCII
+	// nanoseconds since the Unix epoch.
+	HeaderTimestamp = "X-Timestamp"
+)
+
+// HeaderNSQDAddress is the address of the nsqd that delivered the message,
+// set only with WithSourceAddressHeader.
+const HeaderNSQDAddress = "X-NSQD-Address"
+
+// HeaderChannel is the channel that received the message, set only on messages
+// received with SubscribeChannels.
+const HeaderChannel = "X-Channel"
+
+// WithSourceAddressHeader sets HeaderNSQDAddress on received messages.
+func WithSourceAddressHeader() ControllerOption {
+	return func(controller *Controller) { controller.sourceAddressHeader = true }
+}
+
+// ParseAttempts returns the attempts count of a received message. ok is false
+// if the header is missing or malformed.
+func ParseAttempts(bm extensions.BrokerMessage) (attempts uint16, ok bool) {
+	v, err := strconv.ParseUint(string(bm.Headers[HeaderAttempts]), 10, 16)
+	if err != nil {
+		return 0, false
+	}
+
+	return uint16(v), true
+}
+
+// MessageTime returns when nsqd received the message, from HeaderTimestamp in
+// nanoseconds since the Unix epoch. ok is false if the header is missing or
+// malformed.
+func MessageTime(bm extensions.BrokerMessage) (t time.Time, ok bool) {
+	ns, err := strconv.ParseInt(string(bm.Headers[HeaderTimestamp]), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, ns), true
+}
@@ -0,0 +1,111 @@
+package nsq
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+	"github.com/nsqio/go-nsq"
+)
+
+func newTestMessage(id string, body []byte) *nsq.Message {
+	var msgID nsq.MessageID
+	copy(msgID[:], id)
+
+	return nsq.NewMessage(msgID, body)
+}
+
+func TestMessageIDHeader(t *testing.T) {
+	c := newTestController(t)
+	message := newTestMessage("0a1b2c3d4e5f6789", []byte("payload"))
+
+	bm := c.brokerMessage(message)
+
+	id := string(bm.Headers[HeaderMessageID])
+	if !regexp.MustCompile(`^[0-9a-f]{16}$`).MatchString(id) {
+		t.Fatalf("%s = %q, want 16 hexadecimal characters", HeaderMessageID, id)
+	}
+	if id != string(message.ID[:]) {
+		t.Errorf("%s = %q, want %q", HeaderMessageID, id, message.ID[:])
+	}
+
+	// The header must not alias the message
+	message.ID[0] = 'f'
+	if got := string(bm.Headers[HeaderMessageID]); got != id {
+		t.Errorf("%s changed with the message to %q", HeaderMessageID, got)
+	}
+}
+
+func TestParseAttempts(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    uint16
+		wantOK  bool
+		missing bool
+	}{
+		{value: "3", want: 3, wantOK: true},
+		{value: "65535", want: 65535, wantOK: true},
+		{value: "65536"},
+		{value: "-1"},
+		{value: "three"},
+		{value: ""},
+		{missing: true},
+	}
+
+	for _, tt := range tests {
+		bm := extensions.BrokerMessage{Headers: map[string][]byte{}}
+		if !tt.missing {
+			bm.Headers[HeaderAttempts] = []byte(tt.value)
+		}
+
+		got, ok := ParseAttempts(bm)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("ParseAttempts(%q) = %d, %v, want %d, %v", tt.value, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestSourceAddressHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []ControllerOption
+		want    string
+		wantSet bool
+	}{
+		{name: "enabled", options: []ControllerOption{WithSourceAddressHeader()}, want: "nsqd-1:4150", wantSet: true},
+		{name: "disabled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestController(t, tt.options...)
+			message := newTestMessage("0a1b2c3d4e5f6789", nil)
+			message.NSQDAddress = "nsqd-1:4150"
+
+			got, ok := c.brokerMessage(message).Headers[HeaderNSQDAddress]
+			if string(got) != tt.want || ok != tt.wantSet {
+				t.Errorf("%s = %q (set %v), want %q (set %v)", HeaderNSQDAddress, got, ok, tt.want, tt.wantSet)
+			}
+		})
+	}
+}
+
+func TestMessageTime(t *testing.T) {
+	want := time.Date(2024, time.March, 1, 12, 30, 0, 123456789, time.UTC)
+	message := newTestMessage("0a1b2c3d4e5f6789", nil)
+	message.Timestamp = want.UnixNano()
+
+	c := newTestController(t)
+	got, ok := MessageTime(c.brokerMessage(message))
+	if !ok || !got.Equal(want) {
+		t.Errorf("MessageTime() = %v, %v, want %v, true", got, ok, want)
+	}
+
+	for _, value := range []string{"", "yesterday", "1.5e18"} {
+		bm := extensions.BrokerMessage{Headers: map[string][]byte{HeaderTimestamp: []byte(value)}}
+		if got, ok := MessageTime(bm); ok || !got.IsZero() {
+			t.Errorf("MessageTime(%q) = %v, %v, want zero time, false", value, got, ok)
+		}
+	}
+}
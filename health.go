@@ -0,0 +1,52 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Health checks the broker is usable: every producer must answer a ping, and
+// so must nsqlookupd addresses set with WithLookupdHTTPAddress. The returned
+// error joins the failure of every unhealthy component.
+func (c *Controller) Health(ctx context.Context) error {
+	producers := c.allProducers()
+	errs := make([]error, 0, len(producers)+len(c.lookupdHTTPAddrs))
+	for _, p := range producers {
+		if err := ping(ctx, p); err != nil {
+			errs = append(errs, fmt.Errorf("nsqd %s: %w", p, err))
+		}
+	}
+
+	for _, addr := range c.lookupdHTTPAddrs {
+		if err := c.pingLookupd(ctx, addr); err != nil {
+			errs = append(errs, fmt.Errorf("nsqlookupd %s: %w", addr, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// PingLatency measures the round trip of a ping to nsqd with the primary
+// producer, giving up when ctx is done. The first ping may include connecting.
+func (c *Controller) PingLatency(ctx context.Context) (time.Duration, error) {
+	p := c.allProducers()[0]
+
+	start := time.Now()
+	if err := ping(ctx, p); err != nil {
+		return 0, fmt.Errorf("nsqd %s: %w", p, err)
+	}
+
+	return time.Since(start), nil
+}
+
+func (c *Controller) pingLookupd(ctx context.Context, addr string) error {
+	resp, err := c.doHTTP(ctx, http.MethodGet, addr, "/ping", nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
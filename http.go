@@ -0,0 +1,101 @@
+package nsq
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// maxErrorBodySize limits how much of an unexpected response body ends up in
+// the error.
+const maxErrorBodySize = 256
+
+// statusError describes a non-200 response, with the beginning of its body.
+type statusError struct {
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+func newStatusError(resp *http.Response) *statusError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+
+	return &statusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: body}
+}
+
+func (e *statusError) Error() string {
+	if len(e.Body) == 0 {
+		return fmt.Sprintf("unexpected status %s", e.Status)
+	}
+
+	return fmt.Sprintf("unexpected status %s: %q", e.Status, e.Body)
+}
+
+// defaultHTTPClient returns a client using tlsConfig, if set, on top of the
+// default transport, so proxies from the environment and timeouts still apply.
+func defaultHTTPClient(tlsConfig *tls.Config) *http.Client {
+	client := &http.Client{Timeout: defaultHTTPTimeout}
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		client.Transport = transport
+	}
+
+	return client
+}
+
+func (c *Controller) httpScheme() string {
+	if c.tlsConfig != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// getJSON gets path from addr, then decodes the JSON response into out. Non
+// 200 responses return a *statusError.
+func (c *Controller) getJSON(ctx context.Context, addr, path string, query url.Values, out any) error {
+	resp, err := c.doHTTP(ctx, http.MethodGet, addr, path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("parsing response: %w", err)
+	}
+
+	return nil
+}
+
+// doHTTP sends a request to addr. Non 200 responses return a *statusError,
+// otherwise the caller must close the response body.
+func (c *Controller) doHTTP(ctx context.Context, method, addr, path string, query url.Values) (*http.Response, error) {
+	endpoint := (&url.URL{
+		Scheme:   c.httpScheme(),
+		Host:     addr,
+		Path:     path,
+		RawQuery: query.Encode(),
+	}).String()
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, newStatusError(resp)
+	}
+
+	return resp, nil
+}
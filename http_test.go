@@ -0,0 +1,31 @@
+package nsq
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+)
+
+func TestDefaultHTTPClientTLS(t *testing.T) {
+	tlsConfig := &tls.Config{ServerName: "nsqlookupd"}
+	transport, ok := defaultHTTPClient(tlsConfig).Transport.(*http.Transport)
+	if !ok {
+		t.Fatal("Transport isn't an *http.Transport")
+	}
+
+	if transport.TLSClientConfig != tlsConfig {
+		t.Error("TLSClientConfig isn't the given config")
+	}
+	if transport.Proxy == nil {
+		t.Error("Proxy not set, want proxies from the environment")
+	}
+	if transport.TLSHandshakeTimeout == 0 || transport.IdleConnTimeout == 0 {
+		t.Error("timeouts not set, want those of the default transport")
+	}
+	if !transport.ForceAttemptHTTP2 {
+		t.Error("ForceAttemptHTTP2 not set, want HTTP/2 as with the default transport")
+	}
+	if transport == http.DefaultTransport {
+		t.Error("the default transport was modified")
+	}
+}
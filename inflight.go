@@ -0,0 +1,47 @@
+package nsq
+
+import "fmt"
+
+// WithGlobalMaxInFlight sets how many messages may be in flight across all
+// subscriptions of the controller. It's divided evenly between them, each
+// getting at least one, and recomputed whenever a subscription is added or
+// removed.
+func WithGlobalMaxInFlight(n int) ControllerOption {
+	if n < 1 {
+		return withError(fmt.Errorf("invalid global max in flight %d: must be at least 1", n))
+	}
+
+	return func(controller *Controller) { controller.globalMaxInFlight = n }
+}
+
+// rebalanceMaxInFlight divides the global max in flight between subscriptions
+// that aren't paused. c.mu must be held.
+func (c *Controller) rebalanceMaxInFlight() {
+	if c.globalMaxInFlight == 0 {
+		return
+	}
+
+	n := c.maxInFlight()
+	for s := range c.subscriptions {
+		if !s.paused {
+			s.consumer.ChangeMaxInFlight(n)
+		}
+	}
+}
+
+// maxInFlight returns the max in flight of subscriptions that aren't paused.
+// c.mu must be held.
+func (c *Controller) maxInFlight() int {
+	if c.globalMaxInFlight == 0 {
+		return c.consumerConfig.MaxInFlight
+	}
+
+	active := 0
+	for s := range c.subscriptions {
+		if !s.paused {
+			active++
+		}
+	}
+
+	return max(1, c.globalMaxInFlight/max(1, active))
+}
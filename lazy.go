@@ -0,0 +1,82 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+)
+
+// lazyConnectInterval is how often lazy subscriptions try to connect, see
+// WithLazyConnect.
+const lazyConnectInterval = time.Second
+
+// WithLazyConnect makes subscribing succeed without connecting to nsqd: the
+// consumer and its handlers are registered, then connection is tried right
+// away and every second in the background until it succeeds, or Start is
+// called. Subscribing then doesn't depend on the broker being up first.
+//
+// Until connected, a subscription gets no messages. Canceling it stops trying
+// to connect, it doesn't matter whether it ever connected.
+func WithLazyConnect() ControllerOption {
+	return func(controller *Controller) { controller.lazyConnect = true }
+}
+
+// Start connects the subscriptions of topic right away, rather than waiting
+// for their next attempt with WithLazyConnect. With a '#channel' suffix, only
+// the subscription to that channel is started. Connected subscriptions are
+// left as they are.
+func (c *Controller) Start(ctx context.Context, topic string) error {
+	c.mu.Lock()
+	subs := c.matchSubscriptions(topic)
+	c.mu.Unlock()
+	if len(subs) == 0 {
+		return fmt.Errorf("%w: %s", ErrSubscriptionNotFound, topic)
+	}
+
+	var errs []error
+	for _, s := range subs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := c.connectSubscription(ctx, s); err != nil {
+			errs = append(errs, fmt.Errorf("connecting consumer of topic %q, channel %q: %w", s.topic, s.channel, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// connectLazily tries connecting s until it succeeds, stops or the controller
+// shuts down.
+func (c *Controller) connectLazily(s *subscription) {
+	for c.connectSubscription(context.Background(), s) != nil {
+		select {
+		case <-c.clock.After(lazyConnectInterval):
+		case <-s.done:
+			return
+		case <-c.shutdown:
+			return
+		}
+	}
+}
+
+// connectSubscription connects s, unless it's already connected.
+func (c *Controller) connectSubscription(ctx context.Context, s *subscription) error {
+	if s.connected.Load() {
+		return nil
+	}
+
+	if err := c.connectConsumer(s.consumer); err != nil {
+		return err
+	}
+	if s.connected.CompareAndSwap(false, true) && c.logging {
+		c.logger.Info(ctx, "subscription connected",
+			extensions.LogInfo{Key: "topic", Value: s.topic},
+			extensions.LogInfo{Key: "channel", Value: s.channel})
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package nsq
+
+import (
+	"context"
+	"strings"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+	"github.com/nsqio/go-nsq"
+)
+
+// WithNSQLogLevel sets the minimum level of go-nsq logs forwarded to the
+// controller logger. Defaults to nsq.LogLevelInfo.
+func WithNSQLogLevel(level nsq.LogLevel) ControllerOption {
+	return func(controller *Controller) { controller.nsqLogLevel = level }
+}
+
+// nsqLogger forwards go-nsq logs to an extensions.Logger.
+type nsqLogger struct {
+	logger extensions.Logger
+}
+
+// Output implements go-nsq logger interface. Lines start with their level,
+// e.g. "INF    1 [topic/channel] connecting to nsqd".
+func (l nsqLogger) Output(_ int, s string) error {
+	ctx, source := context.Background(), extensions.LogInfo{Key: "source", Value: "go-nsq"}
+
+	switch {
+	case strings.HasPrefix(s, nsq.LogLevelError.String()):
+		l.logger.Error(ctx, s, source)
+	case strings.HasPrefix(s, nsq.LogLevelWarning.String()):
+		l.logger.Warning(ctx, s, source)
+	default:
+		l.logger.Info(ctx, s, source)
+	}
+
+	return nil
+}
+
+// logResult logs the outcome of an operation, at info level on success and at
+// error level with the error otherwise.
+//
+// Callers check c.logging first, so that nothing is built for DummyLogger.
+func (c *Controller) logResult(ctx context.Context, msg string, err error, info ...extensions.LogInfo) {
+	if err != nil {
+		c.logger.Error(ctx, msg+" failed", append(info, extensions.LogInfo{Key: "error", Value: err.Error()})...)
+		return
+	}
+
+	c.logger.Info(ctx, msg, info...)
+}
@@ -0,0 +1,231 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// maxConcurrentLookups bounds how many nsqlookupd are queried at once.
+	maxConcurrentLookups = 8
+
+	// defaultHTTPTimeout is the timeout of the HTTP client used when none is
+	// set with WithHTTPClient.
+	defaultHTTPTimeout = 10 * time.Second
+)
+
+// ErrNoLookupdAddress is returned when there is no nsqlookupd HTTP address to
+// query.
+var ErrNoLookupdAddress = errors.New("no nsqlookupd http address configured")
+
+// WithLookupdHTTPAddress sets nsqlookupd HTTP addresses (e.g. "nsqlookupd:4161")
+// used by LookupTopics. Without it, the controller address is used.
+func WithLookupdHTTPAddress(addrs ...string) ControllerOption {
+	return func(controller *Controller) {
+		controller.lookupdHTTPAddrs = append(controller.lookupdHTTPAddrs, addrs...)
+	}
+}
+
+// WithHTTPClient sets the client used for HTTP requests to nsqlookupd. By
+// default, a client with a 10 seconds timeout is used. It can't be combined
+// with WithTLSConfig or WithMutualTLS: the client transport must carry its own
+// TLS config.
+func WithHTTPClient(client *http.Client) ControllerOption {
+	return func(controller *Controller) { controller.httpClient = client }
+}
+
+// WithIgnoreLookupErrors makes LookupTopics succeed silently as long as one
+// nsqlookupd answers.
+func WithIgnoreLookupErrors() ControllerOption {
+	return func(controller *Controller) { controller.ignoreLookupErrors = true }
+}
+
+// LookupTopics returns topics known by nsqlookupd. All addresses are queried
+// concurrently and their topics merged.
+//
+// If some of them fail, merged topics are returned along with the joined
+// errors, unless WithIgnoreLookupErrors is used.
+//
+// With WithLookupCacheTTL, topics are cached: see LookupTopicsFresh to bypass
+// the cache.
+func (c *Controller) LookupTopics(ctx context.Context) ([]string, error) {
+	if c.lookupCache == nil {
+		return c.LookupTopicsFresh(ctx)
+	}
+
+	if topics, ok := c.lookupCache.get(c.clock.Now()); ok {
+		return topics, nil
+	}
+
+	topics, err := c.LookupTopicsFresh(ctx)
+	if err == nil || c.noStaleLookups {
+		return topics, err
+	}
+
+	stale, ok := c.lookupCache.stale()
+	if !ok {
+		return topics, err
+	}
+	c.logger.Warning(ctx, "looking up topics failed, serving cached topics",
+		extensions.LogInfo{Key: "topics", Value: len(stale)},
+		extensions.LogInfo{Key: "error", Value: err.Error()})
+
+	return stale, nil
+}
+
+// LookupTopicsFresh is like LookupTopics, but always queries nsqlookupd,
+// refreshing the cache of WithLookupCacheTTL when all of them answer.
+func (c *Controller) LookupTopicsFresh(ctx context.Context) ([]string, error) {
+	addrs := c.lookupdAddrs()
+	if len(addrs) == 0 {
+		return nil, ErrNoLookupdAddress
+	}
+
+	topics, err := c.lookupAll(ctx, addrs, c.lookupTopics)
+	if c.logging {
+		c.logResult(ctx, "looking up topics", err, extensions.LogInfo{Key: "topics", Value: len(topics)})
+	}
+	if err == nil && c.lookupCache != nil {
+		c.lookupCache.set(topics, c.clock.Now())
+	}
+
+	return topics, err
+}
+
+// LookupChannels returns channels of topic known by nsqlookupd. Like with
+// LookupTopics, all addresses are queried and their channels merged.
+//
+// A topic unknown by nsqlookupd has no channels: an empty slice is returned,
+// without error.
+func (c *Controller) LookupChannels(ctx context.Context, topic string) ([]string, error) {
+	addrs := c.lookupdAddrs()
+	if len(addrs) == 0 {
+		return nil, ErrNoLookupdAddress
+	}
+
+	channels, err := c.lookupAll(ctx, addrs, func(ctx context.Context, addr string) ([]string, error) {
+		return c.lookupChannels(ctx, addr, topic)
+	})
+	if channels == nil && err == nil {
+		channels = []string{}
+	}
+
+	return channels, err
+}
+
+// lookupAll calls lookup concurrently on every address, then merges results.
+func (c *Controller) lookupAll(ctx context.Context, addrs []string,
+	lookup func(ctx context.Context, addr string) ([]string, error),
+) ([]string, error) {
+	results := make([][]string, len(addrs))
+	errs := make([]error, len(addrs))
+
+	var g errgroup.Group
+	g.SetLimit(maxConcurrentLookups)
+	for i, addr := range addrs {
+		i, addr := i, addr
+		g.Go(func() error {
+			if results[i], errs[i] = lookup(ctx, addr); errs[i] != nil {
+				errs[i] = fmt.Errorf("%s: %w", addr, errs[i])
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	var merged []string
+	seen := make(map[string]struct{})
+	succeeded := false
+	for i := range addrs {
+		if errs[i] != nil {
+			continue
+		}
+		succeeded = true
+
+		for _, v := range results[i] {
+			if _, ok := seen[v]; !ok {
+				seen[v] = struct{}{}
+				merged = append(merged, v)
+			}
+		}
+	}
+
+	switch err := errors.Join(errs...); {
+	case !succeeded:
+		return nil, err
+	case c.ignoreLookupErrors:
+		return merged, nil
+	default:
+		return merged, err
+	}
+}
+
+// lookupdAddrs returns nsqlookupd HTTP addresses, falling back to the
+// controller address.
+func (c *Controller) lookupdAddrs() []string {
+	if len(c.lookupdHTTPAddrs) > 0 {
+		return c.lookupdHTTPAddrs
+	}
+	if c.addr != "" {
+		return []string{c.addr}
+	}
+
+	return nil
+}
+
+func (c *Controller) lookupTopics(ctx context.Context, addr string) ([]string, error) {
+	var body struct {
+		Topics []string `json:"topics"`
+	}
+	if err := c.getJSON(ctx, addr, "/topics", nil, &body); err != nil {
+		return nil, fmt.Errorf("trying to get list of topics from nsqlookupd: %w", err)
+	}
+
+	return body.Topics, nil
+}
+
+func (c *Controller) lookupChannels(ctx context.Context, addr, topic string) ([]string, error) {
+	var body struct {
+		Channels []string `json:"channels"`
+	}
+
+	err := c.getJSON(ctx, addr, "/channels", url.Values{"topic": {topic}}, &body)
+	var se *statusError
+	if errors.As(err, &se) && se.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("trying to get list of channels from nsqlookupd: %w", err)
+	}
+
+	return body.Channels, nil
+}
+
+// LookupTopicsFiltered is like LookupTopics, but only returns topics for which
+// filter returns true.
+func (c *Controller) LookupTopicsFiltered(ctx context.Context, filter func(topic string) bool) ([]string, error) {
+	topics, err := c.LookupTopics(ctx)
+
+	filtered := topics[:0]
+	for _, topic := range topics {
+		if filter(topic) {
+			filtered = append(filtered, topic)
+		}
+	}
+
+	return filtered, err
+}
+
+// TopicPrefix returns a LookupTopicsFiltered filter matching topics starting
+// with prefix.
+func TopicPrefix(prefix string) func(topic string) bool {
+	return func(topic string) bool { return strings.HasPrefix(topic, prefix) }
+}
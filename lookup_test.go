@@ -0,0 +1,123 @@
+package nsq
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// lookupdServer serves body on path, as nsqlookupd would.
+func lookupdServer(t *testing.T, newServer func(http.Handler) *httptest.Server, path string, status int, body string) *httptest.Server {
+	t.Helper()
+
+	srv := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestLookupTopicsTLS(t *testing.T) {
+	srv := lookupdServer(t, httptest.NewTLSServer, "/topics", http.StatusOK, `{"topics":["orders","payments"]}`)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	c := newTestController(t,
+		WithTLSConfig(&tls.Config{RootCAs: pool}),
+		WithLookupdHTTPAddress(srv.Listener.Addr().String()))
+
+	topics, err := c.LookupTopics(context.Background())
+	if err != nil {
+		t.Fatalf("LookupTopics() error = %v", err)
+	}
+	slices.Sort(topics)
+	if want := []string{"orders", "payments"}; !slices.Equal(topics, want) {
+		t.Errorf("LookupTopics() = %v, want %v", topics, want)
+	}
+}
+
+func TestHTTPClientWithTLSConfig(t *testing.T) {
+	_, err := NewController(testAddr, WithHTTPClient(&http.Client{}), WithTLSConfig(&tls.Config{}))
+	if err == nil {
+		t.Error("NewController() error = nil, want an error for the conflicting TLS config")
+	}
+}
+
+func TestLookupTopicsStatusError(t *testing.T) {
+	srv := lookupdServer(t, httptest.NewServer, "/topics", http.StatusInternalServerError, "lookupd is down")
+	c := newTestController(t, WithLookupdHTTPAddress(srv.Listener.Addr().String()))
+
+	_, err := c.LookupTopics(context.Background())
+
+	var se *statusError
+	if !errors.As(err, &se) {
+		t.Fatalf("LookupTopics() error = %v, want a *statusError", err)
+	}
+	if se.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status code = %d, want %d", se.StatusCode, http.StatusInternalServerError)
+	}
+	for _, want := range []string{"500", "lookupd is down"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("LookupTopics() error = %q, want it to contain %q", err, want)
+		}
+	}
+}
+
+func TestLookupChannels(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   []string
+	}{
+		{
+			name:   "known topic",
+			status: http.StatusOK,
+			body:   `{"channels":["archive","billing","tail842#ephemeral"]}`,
+			want:   []string{"archive", "billing", "tail842#ephemeral"},
+		},
+		{
+			name:   "unknown topic",
+			status: http.StatusNotFound,
+			body:   `{"message":"TOPIC_NOT_FOUND"}`,
+			want:   []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotTopic string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotTopic = r.URL.Query().Get("topic")
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			t.Cleanup(srv.Close)
+			c := newTestController(t, WithLookupdHTTPAddress(srv.Listener.Addr().String()))
+
+			channels, err := c.LookupChannels(context.Background(), "orders")
+			if err != nil {
+				t.Fatalf("LookupChannels() error = %v", err)
+			}
+			slices.Sort(channels)
+			if channels == nil || !slices.Equal(channels, tt.want) {
+				t.Errorf("LookupChannels() = %#v, want %#v", channels, tt.want)
+			}
+			if gotTopic != "orders" {
+				t.Errorf("topic query = %q, want %q", gotTopic, "orders")
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package nsq
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WithLookupCacheTTL makes LookupTopics cache topics for ttl, sparing
+// nsqlookupd from polling loops. Once expired, the next call queries
+// nsqlookupd again: if that fails, the expired topics are returned and a
+// warning logged, unless WithoutStaleLookups is used.
+func WithLookupCacheTTL(ttl time.Duration) ControllerOption {
+	if ttl <= 0 {
+		return withError(fmt.Errorf("invalid lookup cache ttl %v: must be positive", ttl))
+	}
+
+	return func(controller *Controller) { controller.lookupCache = &lookupCache{ttl: ttl} }
+}
+
+// WithoutStaleLookups makes LookupTopics return the error of a failed refresh
+// rather than the expired topics of WithLookupCacheTTL.
+func WithoutStaleLookups() ControllerOption {
+	return func(controller *Controller) { controller.noStaleLookups = true }
+}
+
+// lookupCache holds the topics of the last successful lookup.
+type lookupCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	topics  []string
+	fetched time.Time
+	cached  bool
+}
+
+// get returns a copy of the cached topics, unless they expired by now.
+func (l *lookupCache) get(now time.Time) ([]string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.cached || now.Sub(l.fetched) >= l.ttl {
+		return nil, false
+	}
+
+	return append([]string(nil), l.topics...), true
+}
+
+// stale returns a copy of the cached topics, even expired.
+func (l *lookupCache) stale() ([]string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]string(nil), l.topics...), l.cached
+}
+
+func (l *lookupCache) set(topics []string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.topics, l.fetched, l.cached = append([]string(nil), topics...), now, true
+}
@@ -0,0 +1,310 @@
+// Package memory provides an in-memory broker routing messages like nsqd, to
+// test code built on the NSQ controller without running nsqd.
+//
+// Like with nsqd, every channel of a topic gets a copy of each message, and
+// subscriptions to the same channel share its messages. Topics accept the
+// same '#channel' suffix as the NSQ controller.
+package memory
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions/brokers"
+)
+
+const (
+	// defaultChannelName is the channel of subscriptions without '#channel'
+	// suffix, as with the NSQ controller.
+	defaultChannelName = "default"
+
+	// queueSize is how many messages a channel holds before Publish blocks,
+	// the default --mem-queue-size of nsqd.
+	queueSize = 10000
+)
+
+// ErrBrokerClosed is returned when publishing or subscribing after Close.
+var ErrBrokerClosed = errors.New("broker is closed")
+
+// Broker is an in-memory extensions.BrokerController.
+type Broker struct {
+	queueGroup string
+
+	mu     sync.Mutex
+	topics map[string]*topic
+	closed bool
+	done   chan struct{}
+}
+
+var _ extensions.BrokerController = (*Broker)(nil)
+
+// BrokerOption is a function that can be used to configure an in-memory
+// broker.
+type BrokerOption func(broker *Broker)
+
+// WithQueueGroup sets the channel of subscriptions without '#channel' suffix,
+// "default" otherwise.
+func WithQueueGroup(name string) BrokerOption {
+	return func(broker *Broker) { broker.queueGroup = name }
+}
+
+// NewBroker creates a new in-memory broker.
+func NewBroker(options ...BrokerOption) *Broker {
+	b := &Broker{
+		queueGroup: defaultChannelName,
+		topics:     make(map[string]*topic),
+		done:       make(chan struct{}),
+	}
+
+	for _, option := range options {
+		option(b)
+	}
+
+	return b
+}
+
+// topic holds its channels, and messages published before any channel exists,
+// given to the first one.
+type topic struct {
+	channels map[string]*channel
+	pending  []extensions.BrokerMessage
+}
+
+// channel is a queue of messages, shared by its subscriptions.
+type channel struct {
+	mu       sync.Mutex
+	messages []extensions.BrokerMessage
+	// changed is closed, then replaced, whenever messages change.
+	changed chan struct{}
+}
+
+func newChannel(messages []extensions.BrokerMessage) *channel {
+	return &channel{messages: messages, changed: make(chan struct{})}
+}
+
+// push appends bm to ch, waiting while ch is full until ctx or done is done.
+func (ch *channel) push(ctx context.Context, bm extensions.BrokerMessage, done <-chan struct{}) error {
+	for {
+		ch.mu.Lock()
+		if len(ch.messages) < queueSize {
+			ch.messages = append(ch.messages, bm)
+			ch.notify()
+			ch.mu.Unlock()
+			return nil
+		}
+		changed := ch.changed
+		ch.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+			return ErrBrokerClosed
+		}
+	}
+}
+
+// pop takes the first message of ch, waiting for one until stop or done is
+// closed.
+func (ch *channel) pop(stop, done <-chan struct{}) (extensions.BrokerMessage, bool) {
+	for {
+		ch.mu.Lock()
+		if len(ch.messages) > 0 {
+			bm := ch.messages[0]
+			ch.messages = ch.messages[1:]
+			ch.notify()
+			ch.mu.Unlock()
+			return bm, true
+		}
+		changed := ch.changed
+		ch.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-stop:
+			return extensions.BrokerMessage{}, false
+		case <-done:
+			return extensions.BrokerMessage{}, false
+		}
+	}
+}
+
+// requeue puts bm back first in ch, as it was taken but not transmitted.
+func (ch *channel) requeue(bm extensions.BrokerMessage) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.messages = append([]extensions.BrokerMessage{bm}, ch.messages...)
+	ch.notify()
+}
+
+// notify wakes up waiters of ch. ch.mu must be held.
+func (ch *channel) notify() {
+	close(ch.changed)
+	ch.changed = make(chan struct{})
+}
+
+// Publish a message to every channel of the topic. It blocks while a channel
+// is full, until ctx is done.
+func (b *Broker) Publish(ctx context.Context, name string, bm extensions.BrokerMessage) error {
+	name, _ = split(name)
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrBrokerClosed
+	}
+	t := b.topic(name)
+	if len(t.channels) == 0 {
+		t.pending = append(t.pending, copyMessage(bm))
+		b.mu.Unlock()
+		return nil
+	}
+	channels := make([]*channel, 0, len(t.channels))
+	for _, ch := range t.channels {
+		channels = append(channels, ch)
+	}
+	b.mu.Unlock()
+
+	for _, ch := range channels {
+		if err := ch.push(ctx, copyMessage(bm), b.done); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Subscribe to messages of a channel of the topic, the queue group without
+// '#channel' suffix. Messages published before the topic had any channel are
+// given to the first one.
+//
+// The subscription stops once canceled, once ctx is done or once the broker
+// is closed, then its messages channel is closed.
+func (b *Broker) Subscribe(ctx context.Context, name string) (extensions.BrokerChannelSubscription, error) {
+	name, channelName := split(name)
+	if channelName == "" {
+		channelName = b.queueGroup
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return extensions.BrokerChannelSubscription{}, ErrBrokerClosed
+	}
+	ch := b.channel(b.topic(name), channelName)
+	b.mu.Unlock()
+
+	msgChan := make(chan extensions.BrokerMessage, brokers.BrokerMessagesQueueSize)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		forward(ch, msgChan, stop, b.done)
+		close(msgChan)
+	}()
+
+	cancel := make(chan any, 1)
+	go func() {
+		select {
+		case <-cancel:
+			close(stop)
+			<-stopped
+			close(cancel)
+		case <-ctx.Done():
+			close(stop)
+			<-stopped
+			// Leave cancel open: a later Cancel gets its own request back
+			// right away, like with the NSQ controller.
+		}
+	}()
+
+	return extensions.NewBrokerChannelSubscription(msgChan, cancel), nil
+}
+
+// Close closes the broker: subscriptions stop and their messages channels are
+// closed, and publishing or subscribing fail with ErrBrokerClosed.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+	}
+}
+
+// topic returns the topic called name, creating it if needed. b.mu must be
+// held.
+func (b *Broker) topic(name string) *topic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &topic{channels: make(map[string]*channel)}
+		b.topics[name] = t
+	}
+
+	return t
+}
+
+// channel returns the channel of t called name, creating it if needed. b.mu
+// must be held.
+func (b *Broker) channel(t *topic, name string) *channel {
+	ch, ok := t.channels[name]
+	if ok {
+		return ch
+	}
+
+	ch = newChannel(t.pending)
+	t.pending = nil
+	t.channels[name] = ch
+
+	return ch
+}
+
+// forward transmits messages of ch to msgChan until stop or done is closed. A
+// message taken but not transmitted goes back first in ch for other
+// subscriptions, unless the broker is closed.
+func forward(ch *channel, msgChan chan<- extensions.BrokerMessage, stop, done <-chan struct{}) {
+	for {
+		bm, ok := ch.pop(stop, done)
+		if !ok {
+			return
+		}
+
+		select {
+		case msgChan <- bm:
+		case <-stop:
+			select {
+			case <-done:
+			default:
+				ch.requeue(bm)
+			}
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// split splits a topic from its '#channel' suffix.
+func split(name string) (topic, channel string) {
+	if i := strings.IndexRune(name, '#'); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+
+	return name, ""
+}
+
+// copyMessage copies bm, so every channel gets its own.
+func copyMessage(bm extensions.BrokerMessage) extensions.BrokerMessage {
+	headers := make(map[string][]byte, len(bm.Headers))
+	for k, v := range bm.Headers {
+		headers[k] = append([]byte(nil), v...)
+	}
+
+	return extensions.BrokerMessage{Headers: headers, Payload: append([]byte(nil), bm.Payload...)}
+}
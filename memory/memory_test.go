@@ -0,0 +1,227 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions/brokers"
+)
+
+func newTestBroker(t *testing.T, options ...BrokerOption) *Broker {
+	t.Helper()
+
+	b := NewBroker(options...)
+	t.Cleanup(b.Close)
+
+	return b
+}
+
+func subscribe(t *testing.T, b *Broker, name string) extensions.BrokerChannelSubscription {
+	t.Helper()
+
+	sub, err := b.Subscribe(context.Background(), name)
+	if err != nil {
+		t.Fatalf("Subscribe(%q) error = %v", name, err)
+	}
+
+	return sub
+}
+
+func publish(t *testing.T, b *Broker, name string, payloads ...string) {
+	t.Helper()
+
+	for _, payload := range payloads {
+		if err := b.Publish(context.Background(), name, extensions.BrokerMessage{Payload: []byte(payload)}); err != nil {
+			t.Fatalf("Publish(%q) error = %v", name, err)
+		}
+	}
+}
+
+// receive returns the payload of the next message of sub.
+func receive(t *testing.T, sub extensions.BrokerChannelSubscription) string {
+	t.Helper()
+
+	select {
+	case bm, ok := <-sub.MessagesChannel():
+		if !ok {
+			t.Fatal("messages channel closed, want a message")
+		}
+		return string(bm.Payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return ""
+	}
+}
+
+// expectNone checks sub receives nothing more for a while.
+func expectNone(t *testing.T, sub extensions.BrokerChannelSubscription) {
+	t.Helper()
+
+	select {
+	case bm := <-sub.MessagesChannel():
+		t.Errorf("received %q, want nothing", bm.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// expectClosed checks the messages channel of sub gets closed.
+func expectClosed(t *testing.T, sub extensions.BrokerChannelSubscription) {
+	t.Helper()
+
+	for {
+		select {
+		case _, ok := <-sub.MessagesChannel():
+			if !ok {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("messages channel not closed")
+		}
+	}
+}
+
+func TestRouting(t *testing.T) {
+	b := newTestBroker(t)
+	orders := subscribe(t, b, "orders")
+	payments := subscribe(t, b, "payments")
+
+	publish(t, b, "orders", "order")
+	publish(t, b, "payments#ignored", "payment")
+
+	if got := receive(t, orders); got != "order" {
+		t.Errorf("orders received %q, want %q", got, "order")
+	}
+	if got := receive(t, payments); got != "payment" {
+		t.Errorf("payments received %q, want %q", got, "payment")
+	}
+	expectNone(t, orders)
+	expectNone(t, payments)
+}
+
+func TestChannelFanOut(t *testing.T) {
+	b := newTestBroker(t)
+	audit := subscribe(t, b, "orders#audit")
+	billing := subscribe(t, b, "orders#billing")
+
+	publish(t, b, "orders", "order")
+
+	for name, sub := range map[string]extensions.BrokerChannelSubscription{"audit": audit, "billing": billing} {
+		if got := receive(t, sub); got != "order" {
+			t.Errorf("%s received %q, want %q", name, got, "order")
+		}
+		expectNone(t, sub)
+	}
+}
+
+func TestQueueGroupSharing(t *testing.T) {
+	b := newTestBroker(t, WithQueueGroup("workers"))
+	first := subscribe(t, b, "orders")
+	second := subscribe(t, b, "orders#workers")
+
+	payloads := []string{"1", "2", "3", "4"}
+	publish(t, b, "orders", payloads...)
+
+	received := map[string]int{}
+	for range payloads {
+		select {
+		case bm := <-first.MessagesChannel():
+			received[string(bm.Payload)]++
+		case bm := <-second.MessagesChannel():
+			received[string(bm.Payload)]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %v, want every message once", received)
+		}
+	}
+	for _, payload := range payloads {
+		if received[payload] != 1 {
+			t.Errorf("received %v, want every message once", received)
+			break
+		}
+	}
+	expectNone(t, first)
+	expectNone(t, second)
+}
+
+func TestPendingMessages(t *testing.T) {
+	b := newTestBroker(t)
+	publish(t, b, "orders", "1", "2", "3")
+
+	first := subscribe(t, b, "orders#first")
+	later := subscribe(t, b, "orders#later")
+
+	for _, want := range []string{"1", "2", "3"} {
+		if got := receive(t, first); got != want {
+			t.Errorf("received %q, want %q", got, want)
+		}
+	}
+	// Only the first channel gets them, like with nsqd
+	expectNone(t, later)
+}
+
+func TestCancelWhileBlocked(t *testing.T) {
+	b := newTestBroker(t)
+	blocked := subscribe(t, b, "orders")
+
+	// Fill the messages channel, so the subscription holds the next message
+	// when canceled.
+	n := brokers.BrokerMessagesQueueSize + 3
+	for i := 0; i < n; i++ {
+		publish(t, b, "orders", strconv.Itoa(i))
+	}
+	for len(blocked.MessagesChannel()) < brokers.BrokerMessagesQueueSize {
+		time.Sleep(time.Millisecond)
+	}
+	blocked.Cancel(context.Background())
+	expectClosed(t, blocked)
+
+	next := subscribe(t, b, "orders")
+	for i := brokers.BrokerMessagesQueueSize; i < n; i++ {
+		if got, want := receive(t, next), strconv.Itoa(i); got != want {
+			t.Errorf("received %q, want %q", got, want)
+		}
+	}
+	expectNone(t, next)
+}
+
+func TestSubscribeContextCanceled(t *testing.T) {
+	b := newTestBroker(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := b.Subscribe(ctx, "orders")
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	cancel()
+
+	expectClosed(t, sub)
+	// Canceling afterwards doesn't block
+	sub.Cancel(context.Background())
+}
+
+func TestClose(t *testing.T) {
+	b := NewBroker()
+	sub := subscribe(t, b, "orders")
+	publish(t, b, "orders", "order")
+
+	b.Close()
+	b.Close()
+
+	expectClosed(t, sub)
+	if err := b.Publish(context.Background(), "orders", extensions.BrokerMessage{}); !errors.Is(err, ErrBrokerClosed) {
+		t.Errorf("Publish() after Close error = %v, want %v", err, ErrBrokerClosed)
+	}
+	if _, err := b.Subscribe(context.Background(), "orders"); !errors.Is(err, ErrBrokerClosed) {
+		t.Errorf("Subscribe() after Close error = %v, want %v", err, ErrBrokerClosed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sub.Cancel(ctx)
+	if ctx.Err() != nil {
+		t.Error("Cancel() after Close blocked")
+	}
+}
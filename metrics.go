@@ -0,0 +1,31 @@
+package nsq
+
+import "time"
+
+// MetricsRecorder receives metrics about controller operations, to plug in any
+// metrics backend.
+type MetricsRecorder interface {
+	// IncPublish is called for every message published with Publish,
+	// PublishDeferred or PublishBatch.
+	IncPublish(topic string)
+	// IncPublishError is called for every message that failed to publish.
+	IncPublishError(topic string)
+	// IncReceived is called for every message received by a subscription.
+	IncReceived(topic, channel string)
+	// ObserveHandlerDuration is called with the time taken to hand a received
+	// message to its subscription, acknowledgement included in manual ack mode.
+	ObserveHandlerDuration(topic string, d time.Duration)
+}
+
+// WithMetricsRecorder sets a recorder for controller metrics.
+func WithMetricsRecorder(r MetricsRecorder) ControllerOption {
+	return func(controller *Controller) { controller.metrics = r }
+}
+
+// nopMetrics is the MetricsRecorder used by default.
+type nopMetrics struct{}
+
+func (nopMetrics) IncPublish(string)                            {}
+func (nopMetrics) IncPublishError(string)                       {}
+func (nopMetrics) IncReceived(string, string)                   {}
+func (nopMetrics) ObserveHandlerDuration(string, time.Duration) {}
@@ -0,0 +1,52 @@
+package nsq
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+const (
+	// maxNameLength is the maximum length of NSQ topic and channel names.
+	maxNameLength = 64
+
+	ephemeralSuffix = "#ephemeral"
+)
+
+// ErrInvalidName is returned when a topic or channel name would be refused by
+// nsqd.
+var ErrInvalidName = errors.New("invalid name")
+
+var (
+	validName   = regexp.MustCompile(`^[.a-zA-Z0-9_-]+(#ephemeral)?$`)
+	invalidChar = regexp.MustCompile(`[^.a-zA-Z0-9_-]`)
+)
+
+// validateName checks name against NSQ rules, kind is either "topic" or
+// "channel".
+func validateName(kind, name string) error {
+	if len(name) == 0 || len(name) > maxNameLength || !validName.MatchString(name) {
+		return fmt.Errorf("%w: %s %q must be 1 to %d characters of [.a-zA-Z0-9_-], optionally ending with '#ephemeral'",
+			ErrInvalidName, kind, name, maxNameLength)
+	}
+
+	return nil
+}
+
+// ephemeralChannelName returns a channel name unique to this call, made of
+// the hostname and a random part from r.
+func ephemeralChannelName(r randSource) string {
+	hostname, _ := os.Hostname()
+	hostname = invalidChar.ReplaceAllString(hostname, "_")
+
+	random := fmt.Sprintf("%08x", r.Uint32())
+	if maxHost := maxNameLength - len(ephemeralSuffix) - len(random) - 1; len(hostname) > maxHost {
+		hostname = hostname[:maxHost]
+	}
+	if hostname == "" {
+		return random + ephemeralSuffix
+	}
+
+	return hostname + "-" + random + ephemeralSuffix
+}
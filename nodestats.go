@@ -0,0 +1,68 @@
+package nsq
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// NodeStats are statistics of a nsqd node, as served by its /stats endpoint.
+type NodeStats struct {
+	Version   string       `json:"version"`
+	Health    string       `json:"health"`
+	StartTime int64        `json:"start_time"` // Unix seconds
+	Topics    []TopicStats `json:"topics"`
+}
+
+// TopicStats are statistics of a topic on a nsqd node.
+type TopicStats struct {
+	TopicName    string         `json:"topic_name"`
+	Channels     []ChannelStats `json:"channels"`
+	Depth        int64          `json:"depth"`
+	BackendDepth int64          `json:"backend_depth"`
+	MessageCount uint64         `json:"message_count"`
+	MessageBytes uint64         `json:"message_bytes"`
+	Paused       bool           `json:"paused"`
+}
+
+// ChannelStats are statistics of a channel on a nsqd node. Depth counts
+// messages waiting to be delivered, in memory and on disk.
+type ChannelStats struct {
+	ChannelName   string        `json:"channel_name"`
+	Depth         int64         `json:"depth"`
+	BackendDepth  int64         `json:"backend_depth"`
+	InFlightCount int           `json:"in_flight_count"`
+	DeferredCount int           `json:"deferred_count"`
+	MessageCount  uint64        `json:"message_count"`
+	RequeueCount  uint64        `json:"requeue_count"`
+	TimeoutCount  uint64        `json:"timeout_count"`
+	ClientCount   int           `json:"client_count"`
+	Clients       []ClientStats `json:"clients"`
+	Paused        bool          `json:"paused"`
+}
+
+// ClientStats are statistics of a consumer connected to a channel.
+type ClientStats struct {
+	ClientID      string `json:"client_id"`
+	Hostname      string `json:"hostname"`
+	UserAgent     string `json:"user_agent"`
+	RemoteAddress string `json:"remote_address"`
+	ReadyCount    int64  `json:"ready_count"`
+	InFlightCount int64  `json:"in_flight_count"`
+	MessageCount  uint64 `json:"message_count"`
+	FinishCount   uint64 `json:"finish_count"`
+	RequeueCount  uint64 `json:"requeue_count"`
+	ConnectTime   int64  `json:"connect_ts"` // Unix seconds
+}
+
+// NodeStats fetches statistics of the nsqd at nsqdHTTPAddr (e.g.
+// "nsqd:4151"), such as channels depth. Non 200 responses are returned as
+// errors.
+func (c *Controller) NodeStats(ctx context.Context, nsqdHTTPAddr string) (*NodeStats, error) {
+	var stats NodeStats
+	if err := c.getJSON(ctx, nsqdHTTPAddr, "/stats", url.Values{"format": {"json"}}, &stats); err != nil {
+		return nil, fmt.Errorf("trying to get stats from nsqd: %w", err)
+	}
+
+	return &stats, nil
+}
@@ -2,25 +2,153 @@ package nsq
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/http"
-	"net/url"
-	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
 	"github.com/lerenn/asyncapi-codegen/pkg/extensions/brokers"
 	"github.com/nsqio/go-nsq"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const defaultChannelName = "default"
+const (
+	defaultChannelName = "default"
+
+	// defaultDrainTimeout bounds how long stopping consumers may wait for
+	// in-flight messages to drain.
+	defaultDrainTimeout = 30 * time.Second
+)
 
 type Controller struct {
-	addr    string
-	p       *nsq.Producer
-	logger  extensions.Logger
-	connect func(c *nsq.Consumer, addr string) error
+	addr        string
+	logger      extensions.Logger
+	logging     bool // false with DummyLogger, see logResult
+	nsqLogLevel nsq.LogLevel
+
+	// connectSteps connect consumers, starting with the controller address
+	// (nsqlookupd with lookupdConnect), then addresses from WithNSQDAddress
+	// and WithLookupdAddress.
+	connectSteps   []connectStep
+	lookupdConnect bool
+
+	srv                *srvDiscovery
+	srvRefreshInterval time.Duration
+
+	// producers holds the primary producer first, then the failover or shard
+	// ones. They're replaced when rebuilt, under producersMu.
+	producersMu   sync.RWMutex
+	producers     []*nsq.Producer
+	failoverAddrs []string
+	shard         func(topic string) string
+	nextProducer  atomic.Uint64
+	pending       pendingPublishes
+	publishSlots  semaphore
+	publishRetry  backoff
+
+	queueGroup   string
+	topicMap     map[string]string // default channel of topics, see WithTopicChannelMap
+	topicParser  TopicChannelParser
+	ephemeral    bool
+	handlers     int
+	ordered      bool
+	bufferSize   int
+	drainTimeout time.Duration
+	reconnect    backoff
+	lazyConnect  bool
+	retryJitter  Jitter // set by WithRetryJitter, overrides backoff defaults
+	clock        clock
+	rand         randSource
+	connectCheck time.Duration
+	// globalMaxInFlight is shared by all subscriptions, when set.
+	globalMaxInFlight int
+	adaptive          *adaptiveMaxInFlight
+
+	// optionsErr gathers invalid options, returned by NewController.
+	optionsErr error
+
+	producerConfig *nsq.Config
+	consumerConfig *nsq.Config
+	producerTweaks []func(cfg *nsq.Config)
+	consumerTweaks []func(cfg *nsq.Config)
+	tlsConfig      *tls.Config
+	authSecret     func() (string, error)
+	// newBackoffStrategy builds the backoff strategy of each consumer.
+	newBackoffStrategy func() nsq.BackoffStrategy
+
+	httpClient         *http.Client
+	lookupdHTTPAddrs   []string
+	ignoreLookupErrors bool
+	lookupCache        *lookupCache
+	noStaleLookups     bool
+
+	envelope           EnvelopeCodec
+	envelopeAutoDetect bool
+	tracer             trace.Tracer
+	propagator         propagation.TextMapPropagator
+	metrics            MetricsRecorder
+	stats              stats
+	manualAck          bool
+	deliveries         atomic.Uint64
+	deadLetter         func(extensions.BrokerMessage)
+	deadLetterTopic    string
+	deliveryObserver   func(topic, channel string, result DeliveryResult)
+	autoTouch          time.Duration
+	panicPolicy        PanicPolicy
+
+	sourceAddressHeader bool
+	messageSizeLimit    int
+	publishValidator    func(topic string, payload []byte) error
+
+	// closed is set under mu by Close, so no subscription registers after.
+	// shutdown is closed at the same time.
+	closeOnce     sync.Once
+	closed        atomic.Bool
+	shutdown      chan struct{}
+	mu            sync.Mutex
+	subscriptions map[*subscription]struct{}
+
+	// acksMu isn't mu, which is held while changing consumers RDY.
+	acksMu      sync.Mutex
+	pendingAcks map[string]chan error
+
+	repliesMu sync.Mutex
+	replies   map[string]*replyRouter
+}
+
+// subscription is a consumer created by Subscribe, tracked until it's stopped.
+type subscription struct {
+	topic    string
+	channel  string
+	consumer *nsq.Consumer
+
+	// done is closed once the subscription stops. Handlers transmit messages
+	// holding mu for reading, so once done is closed and mu is acquired, none
+	// of them is transmitting anymore.
+	done     chan struct{}
+	stopOnce sync.Once
+	mu       sync.RWMutex
+
+	// paused is guarded by Controller.mu, see Pause.
+	paused bool
+	// maxInFlight is tuned with WithAdaptiveMaxInFlight, guarded by
+	// Controller.mu.
+	maxInFlight int
+	// connected is set once connected with WithLazyConnect.
+	connected atomic.Bool
+}
+
+// stopTransmitting closes done, then waits for handlers to stop transmitting.
+func (s *subscription) stopTransmitting() {
+	s.stopOnce.Do(func() { close(s.done) })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 }
 
 var _ extensions.BrokerController = (*Controller)(nil)
@@ -31,22 +159,120 @@ type ControllerOption func(controller *Controller)
 
 // NewController creates a new NSQ controller.
 func NewController(url string, options ...ControllerOption) (*Controller, error) {
-	p, err := nsq.NewProducer(url, nsq.NewConfig())
-	if err != nil {
-		return nil, err
-	}
-
 	c := &Controller{
-		addr:    url,
-		p:       p,
-		logger:  extensions.DummyLogger{},
-		connect: nsqdConnect,
+		addr:           url,
+		logger:         extensions.DummyLogger{},
+		nsqLogLevel:    nsq.LogLevelInfo,
+		metrics:        nopMetrics{},
+		propagator:     defaultPropagator(),
+		queueGroup:     defaultChannelName,
+		topicParser:    splitChannel(defaultChannelDelimiter),
+		handlers:       1,
+		bufferSize:     brokers.BrokerMessagesQueueSize,
+		drainTimeout:   defaultDrainTimeout,
+		clock:          realClock{},
+		rand:           globalRand{},
+		producerConfig: nsq.NewConfig(),
+		consumerConfig: nsq.NewConfig(),
+		subscriptions:  make(map[*subscription]struct{}),
+		pendingAcks:    make(map[string]chan error),
+		replies:        make(map[string]*replyRouter),
+		shutdown:       make(chan struct{}),
 	}
 
 	// Execute options
 	for _, option := range options {
 		option(c)
 	}
+	if c.optionsErr != nil {
+		return nil, c.optionsErr
+	}
+	if c.adaptive != nil && (c.ordered || c.globalMaxInFlight > 0) {
+		return nil, errors.New("adaptive max in flight can't be combined with global max in flight or ordered delivery")
+	}
+	if c.envelopeAutoDetect && c.envelope == nil {
+		return nil, fmt.Errorf("envelope auto detection: %w", ErrEnvelopeRequired)
+	}
+	if c.retryJitter != 0 {
+		c.reconnect.jitter, c.publishRetry.jitter = c.retryJitter, c.retryJitter
+	}
+	c.reconnect.clock, c.reconnect.rand = c.clock, c.rand
+	c.publishRetry.clock, c.publishRetry.rand = c.clock, c.rand
+	if c.shard != nil && len(c.failoverAddrs) > 0 {
+		return nil, errors.New("sharded producers can't be combined with producer failover")
+	}
+
+	_, dummy := c.logger.(extensions.DummyLogger)
+	c.logging = !dummy
+
+	// Ordered delivery wins over options raising concurrency.
+	if c.ordered {
+		c.handlers = 1
+		c.globalMaxInFlight = 0
+	}
+
+	c.producerConfig = tweakConfig(c.producerConfig, c.producerTweaks)
+	c.consumerConfig = tweakConfig(c.consumerConfig, c.consumerTweaks)
+
+	if err := validateConfig(c.producerConfig); err != nil {
+		return nil, fmt.Errorf("validating producer config: %w", err)
+	}
+	if err := validateConfig(c.consumerConfig); err != nil {
+		return nil, fmt.Errorf("validating consumer config: %w", err)
+	}
+	if timeout := c.consumerConfig.MsgTimeout; timeout > 0 && c.autoTouch >= timeout {
+		return nil, fmt.Errorf("auto touch interval %v must be less than message timeout %v", c.autoTouch, timeout)
+	}
+
+	if c.httpClient != nil && c.tlsConfig != nil {
+		// The TLS config would never reach lookupd requests
+		return nil, errors.New("a custom HTTP client can't be combined with a TLS config: set it on the client transport")
+	}
+	if c.httpClient == nil {
+		c.httpClient = defaultHTTPClient(c.tlsConfig)
+	}
+
+	if err := c.authSecretConfig(c.producerConfig); err != nil {
+		return nil, err
+	}
+
+	if c.srv != nil {
+		if _, _, err := c.srv.resolve(context.Background()); err != nil {
+			return nil, err
+		}
+		c.connectSteps = append(c.connectSteps, c.srv.connect)
+	}
+
+	if c.addr != "" {
+		step := nsqdConnect(c.addr)
+		if c.lookupdConnect {
+			step = nsqlookupdConnect(c.addr)
+		}
+		c.connectSteps = append([]connectStep{step}, c.connectSteps...)
+	}
+
+	for _, addr := range append([]string{url}, c.failoverAddrs...) {
+		p, err := c.newProducer(addr)
+		if err != nil {
+			c.stopProducers()
+			return nil, err
+		}
+		c.producers = append(c.producers, p)
+	}
+
+	if c.connectCheck > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), c.connectCheck)
+		defer cancel()
+
+		if err := ping(ctx, c.producers[0]); err != nil {
+			c.stopProducers()
+			return nil, fmt.Errorf("checking connection to nsqd: %w", err)
+		}
+	}
+
+	if c.srv != nil && c.srvRefreshInterval > 0 {
+		go c.refreshSRV()
+	}
 
 	return c, nil
 }
@@ -56,99 +282,667 @@ func WithLogger(logger extensions.Logger) ControllerOption {
 	return func(controller *Controller) { controller.logger = logger }
 }
 
+// WithQueueGroup sets the channel used by subscriptions when the topic has no
+// '#channel' suffix. In NSQ, consumers sharing a channel split its messages.
+func WithQueueGroup(name string) ControllerOption {
+	return func(controller *Controller) { controller.queueGroup = name }
+}
+
+// WithEphemeralChannel makes every subscription without '#channel' suffix use
+// its own ephemeral channel, deleted by nsqd once the consumer disconnects.
+//
+// Unlike WithQueueGroup, where instances sharing a channel split messages,
+// every instance then receives every message.
+func WithEphemeralChannel() ControllerOption {
+	return func(controller *Controller) { controller.ephemeral = true }
+}
+
+// WithProducerConfig sets a custom nsq.Config used to create the producer,
+// e.g. to tune WriteTimeout or DialTimeout.
+func WithProducerConfig(cfg *nsq.Config) ControllerOption {
+	if cfg == nil {
+		return withError(errors.New("invalid producer config: must not be nil"))
+	}
+
+	return func(controller *Controller) { controller.producerConfig = cfg }
+}
+
+// WithConsumerConfig sets a custom nsq.Config used for every subscription,
+// e.g. to raise MaxInFlight. Each consumer gets its own copy of the config.
+func WithConsumerConfig(cfg *nsq.Config) ControllerOption {
+	if cfg == nil {
+		return withError(errors.New("invalid consumer config: must not be nil"))
+	}
+
+	return func(controller *Controller) { controller.consumerConfig = cfg }
+}
+
+// WithConcurrentHandlers sets how many goroutines handle messages of each
+// subscription, n must be at least 1.
+//
+// Handlers only process what NSQ delivers: with the default MaxInFlight of 1
+// extra handlers stay idle, so raise it accordingly (see WithConsumerConfig).
+func WithConcurrentHandlers(n int) ControllerOption {
+	if n < 1 {
+		return withError(fmt.Errorf("invalid concurrent handlers count %d: must be at least 1", n))
+	}
+
+	return func(controller *Controller) { controller.handlers = n }
+}
+
+// WithOrderedDelivery makes each subscription receive one message at a time,
+// with a single handler and a MaxInFlight of 1, whatever other options say.
+// Messages then reach subscriptions in the order nsqd sends them.
+//
+// Throughput drops to one message per round trip to nsqd. Ordering is best
+// effort: nsqd doesn't order messages from different producers, and requeued
+// or timed out messages are delivered again after the ones sent meanwhile.
+func WithOrderedDelivery() ControllerOption {
+	tweak := withConsumerTweak(func(cfg *nsq.Config) { cfg.MaxInFlight = 1 })
+
+	return func(controller *Controller) {
+		tweak(controller)
+		controller.ordered = true
+	}
+}
+
+// WithSubscriptionBufferSize sets how many received messages a subscription
+// holds until they're read. Values <= 0 keep the default of 64.
+//
+// A small buffer makes slow readers slow NSQ down, as it stops delivering when
+// MaxInFlight messages are pending, while a large one absorbs bursts at the
+// cost of memory.
+func WithSubscriptionBufferSize(n int) ControllerOption {
+	if n <= 0 {
+		n = brokers.BrokerMessagesQueueSize
+	}
+
+	return func(controller *Controller) { controller.bufferSize = n }
+}
+
+// WithDrainTimeout sets how long stopping a subscription waits for its
+// in-flight messages to be processed before giving up.
+func WithDrainTimeout(d time.Duration) ControllerOption {
+	return func(controller *Controller) { controller.drainTimeout = d }
+}
+
+// WithReconnect makes Subscribe retry connecting its consumer up to maxRetries
+// times, doubling the delay between attempts from baseDelay up to 2 minutes,
+// with full jitter by default (see WithRetryJitter). Retries stop when the
+// Subscribe context is done, or the controller is closed.
+func WithReconnect(maxRetries int, baseDelay time.Duration) ControllerOption {
+	if maxRetries < 0 {
+		return withError(fmt.Errorf("invalid reconnect retries %d: must not be negative", maxRetries))
+	}
+	if baseDelay < 0 {
+		return withError(fmt.Errorf("invalid reconnect delay %v: must not be negative", baseDelay))
+	}
+
+	return func(controller *Controller) {
+		controller.reconnect = backoff{maxRetries: maxRetries, baseDelay: baseDelay, jitter: JitterFull}
+	}
+}
+
+// WithConnectCheck makes NewController ping nsqd and fail if it doesn't answer
+// within timeout. Otherwise, connection happens on the first publish.
+func WithConnectCheck(timeout time.Duration) ControllerOption {
+	return func(controller *Controller) { controller.connectCheck = timeout }
+}
+
+// WithLookupdConnect makes consumers discover nsqd through the nsqlookupd at
+// the controller address, rather than connecting to it as nsqd.
 func WithLookupdConnect() ControllerOption {
-	return func(controller *Controller) { controller.connect = nsqlookupdConnect }
+	return func(controller *Controller) { controller.lookupdConnect = true }
 }
 
 // Publish a message to the broker.
-func (c *Controller) Publish(_ context.Context, topic string, bm extensions.BrokerMessage) error {
-	if i := strings.IndexRune(topic, '#'); i >= 0 {
-		topic = topic[:i]
+//
+// If ctx is done before nsqd acknowledges the message, ctx.Err() is returned
+// without waiting any further. The message may still be delivered.
+//
+// Failures are classified as ErrNotConnected, ErrPublishTimeout or
+// ErrPublishRejected when possible, to be checked with errors.Is.
+func (c *Controller) Publish(ctx context.Context, topic string, bm extensions.BrokerMessage) error {
+	_, err := c.PublishWithResult(ctx, topic, bm)
+	return err
+}
+
+// PublishResult describes a message published with PublishWithResult.
+//
+// nsqd only answers "OK" to publications: the ID it gives to the message isn't
+// known by publishers.
+type PublishResult struct {
+	// Topic the message was published to, without '#channel' suffix.
+	Topic string
+	// PayloadSize is the size of the message payload.
+	PayloadSize int
+	// BodySize is the size of the NSQ message body, which differs from
+	// PayloadSize when an envelope codec is set.
+	BodySize int
+	// NSQDAddress is the address of the nsqd that acknowledged the message.
+	NSQDAddress string
+	// Duration is how long it took for nsqd to acknowledge the message.
+	Duration time.Duration
+}
+
+// PublishWithResult is like Publish, but also describes the published message.
+func (c *Controller) PublishWithResult(ctx context.Context, topic string, bm extensions.BrokerMessage) (PublishResult, error) {
+	topic = c.publishTopic(topic)
+	if err := validateName("topic", topic); err != nil {
+		return PublishResult{}, err
+	}
+	if err := c.validatePayload(topic, bm.Payload); err != nil {
+		return PublishResult{}, err
 	}
 
-	return c.p.Publish(topic, bm.Payload)
+	return c.publishMessages(ctx, topic, []extensions.BrokerMessage{bm}, false,
+		func(p *nsq.Producer, bodies [][]byte, done chan *nsq.ProducerTransaction) error {
+			return p.PublishAsync(topic, bodies[0], done)
+		})
 }
 
-// Subscribe to messages from the broker.
-func (c *Controller) Subscribe(ctx context.Context, topic string) (extensions.BrokerChannelSubscription, error) {
-	channel := defaultChannelName
-	if i := strings.IndexRune(topic, '#'); i >= 0 && i < len(topic)-1 {
-		channel = topic[i+1:]
-		topic = topic[:i]
+// publishMessages encodes msgs, then publishes them to topic with call,
+// within a single span whose context their headers carry. Messages are
+// counted in metrics and stats, and the publication is logged. A batch is
+// checked against nsqd default sizes, see PublishBatch.
+func (c *Controller) publishMessages(ctx context.Context, topic string, msgs []extensions.BrokerMessage, batch bool,
+	call func(p *nsq.Producer, bodies [][]byte, done chan *nsq.ProducerTransaction) error,
+) (PublishResult, error) {
+	result := PublishResult{Topic: topic}
+	for _, bm := range msgs {
+		result.PayloadSize += len(bm.Payload)
+		c.metrics.IncPublish(topic)
+		c.stats.published.inc(topic)
 	}
 
-	consumer, err := nsq.NewConsumer(topic, channel, nsq.NewConfig())
+	err := c.tracePublish(ctx, topic, msgs, func(ctx context.Context, msgs []extensions.BrokerMessage) error {
+		bodies, err := c.encodeAll(msgs, batch)
+		if err != nil {
+			return err
+		}
+		for _, body := range bodies {
+			result.BodySize += len(body)
+		}
+
+		start := time.Now()
+		var addr string
+		err = c.send(ctx, topic, func(p *nsq.Producer, done chan *nsq.ProducerTransaction) error {
+			addr = p.String()
+			return call(p, bodies, done)
+		})
+		if err != nil {
+			return err
+		}
+		result.NSQDAddress, result.Duration = addr, time.Since(start)
+
+		return nil
+	})
+	if c.logging {
+		msg, info := "publishing message", []extensions.LogInfo{
+			{Key: "topic", Value: result.Topic},
+			{Key: "nsqd_address", Value: result.NSQDAddress},
+			{Key: "body_size", Value: result.BodySize},
+			{Key: "duration", Value: result.Duration},
+		}
+		if batch {
+			msg, info = "publishing batch", append(info, extensions.LogInfo{Key: "messages", Value: len(msgs)})
+		}
+		c.logResult(ctx, msg, err, info...)
+	}
 	if err != nil {
-		return extensions.BrokerChannelSubscription{}, err
+		for range msgs {
+			c.metrics.IncPublishError(topic)
+			c.stats.publishErrors.inc(topic)
+		}
+		return PublishResult{}, err
 	}
 
-	msgChan := make(chan extensions.BrokerMessage, brokers.BrokerMessagesQueueSize)
-	consumer.AddHandler(messagesHandler(msgChan))
+	return result, nil
+}
 
-	if err := c.connect(consumer, c.addr); err != nil {
-		return extensions.BrokerChannelSubscription{}, err
+// send calls an async producer method, publishing on topic, and waits for its transaction to
+// complete or ctx to be done, retrying as set with WithPublishRetry.
+func (c *Controller) send(ctx context.Context, topic string, call func(p *nsq.Producer, done chan *nsq.ProducerTransaction) error) error {
+	err := c.publishRetry.retry(ctx, func() error { return c.sendOnce(ctx, topic, call) },
+		func(attempt int, delay time.Duration, err error) {
+			c.logger.Warning(ctx, "publishing failed, retrying",
+				extensions.LogInfo{Key: "attempt", Value: attempt},
+				extensions.LogInfo{Key: "delay", Value: delay},
+				extensions.LogInfo{Key: "error", Value: err.Error()})
+		})
+
+	return classifyPublishError(err)
+}
+
+// sendOnce calls an async producer method and waits for its transaction to
+// complete or ctx to be done. With failover producers, the call is tried on
+// each of them until one succeeds.
+//
+// When ctx is done first, ctx.Err() is returned right away, even if go-nsq is
+// still connecting: the message may still be delivered afterwards. Errors are
+// classified with classifyPublishError.
+func (c *Controller) sendOnce(ctx context.Context, topic string, call func(p *nsq.Producer, done chan *nsq.ProducerTransaction) error) error {
+	if c.closed.Load() {
+		return ErrControllerClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return classifyPublishError(err)
+	}
+
+	producers, err := c.nextProducers(topic)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, p := range producers {
+		err := c.sendTo(ctx, p, call)
+		if err != nil && ctx.Err() == nil && connectionLost(err) {
+			if rebuilt, rebuildErr := c.rebuildProducer(ctx, p); rebuildErr == nil {
+				err = c.sendTo(ctx, rebuilt, call)
+			}
+		}
+
+		switch {
+		case err == nil:
+			return nil
+		case ctx.Err() != nil:
+			return classifyPublishError(ctx.Err())
+		}
+		errs = append(errs, classifyPublishError(err))
 	}
 
-	// Create a new subscription
-	sub := extensions.NewBrokerChannelSubscription(msgChan, make(chan any, 1))
-	sub.WaitForCancellationAsync(consumer.Stop)
+	if len(errs) == 1 {
+		return errs[0]
+	}
 
-	return sub, nil
+	return errors.Join(errs...)
 }
 
-func (c *Controller) LookupTopics(ctx context.Context) ([]string, error) {
-	endpoint := (&url.URL{
-		Scheme: "http",
-		Host:   c.addr,
-		Path:   "/topics",
-	}).String()
+// sendTo calls an async method of p and waits for its transaction to complete
+// or ctx to be done. The transaction holds a slot of WithMaxConcurrentPublishes
+// until it completes, unless the publication already holds one.
+func (c *Controller) sendTo(ctx context.Context, p *nsq.Producer, call func(p *nsq.Producer, done chan *nsq.ProducerTransaction) error) error {
+	// Buffered, so the transaction is always consumed, even if nobody is
+	// waiting for it anymore.
+	result := make(chan error, 1)
+	release := func() {}
+	if c.publishSlots != nil && ctx.Value(publishSlotKey{}) == nil {
+		if err := c.publishSlots.acquire(ctx); err != nil {
+			return err
+		}
+		release = c.publishSlots.release
+	}
+
+	c.pending.add()
+	go func() {
+		defer c.pending.done()
+		defer release()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		done := make(chan *nsq.ProducerTransaction, 1)
+		if err := call(p, done); err != nil {
+			result <- err
+			return
+		}
+		result <- (<-done).Error
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// encode returns the NSQ body of bm, wrapped in an envelope if a codec is set.
+// The body must fit WithMaxMessageSize, if set.
+func (c *Controller) encode(bm extensions.BrokerMessage) ([]byte, error) {
+	body := bm.Payload
+	if c.envelope != nil {
+		var err error
+		if body, err = c.envelope.Encode(bm); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.messageSizeLimit > 0 && len(body) > c.messageSizeLimit {
+		return nil, fmt.Errorf("%w: %d bytes, more than the max of %d bytes", ErrMessageTooLarge, len(body), c.messageSizeLimit)
+	}
+
+	return body, nil
+}
+
+// publishTopic strips the '#channel' suffix, meaningless when publishing.
+func (c *Controller) publishTopic(topic string) string {
+	topic, _ = c.parseTopic(topic)
+	return topic
+}
+
+// Subscribe to messages from the broker. The subscription stops once canceled,
+// or once ctx is done.
+func (c *Controller) Subscribe(ctx context.Context, topic string) (extensions.BrokerChannelSubscription, error) {
+	msgChan := make(chan extensions.BrokerMessage, c.bufferSize)
+	topic, channel := c.subscriptionChannel(topic)
+	s, err := c.subscribe(ctx, topic, channel, func(s *subscription) nsq.Handler {
+		return &messagesHandler{
+			controller: c,
+			topic:      s.topic,
+			channel:    s.channel,
+			msgChan:    msgChan,
+			sub:        s,
+		}
+	})
 	if err != nil {
-		return nil, fmt.Errorf("creating request: %w", err)
+		return extensions.BrokerChannelSubscription{}, err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	return newBrokerSubscription(ctx, msgChan, func() {
+		c.stopSubscriptions(ctx, s)
+		c.unregister(s)
+	}), nil
+}
+
+// newBrokerSubscription returns a subscription transmitting msgChan. Once it's
+// canceled, or ctx is done, cleanup is called then msgChan is closed.
+func newBrokerSubscription(ctx context.Context, msgChan chan extensions.BrokerMessage, cleanup func()) extensions.BrokerChannelSubscription {
+	cancel := make(chan any, 1)
+	go func() {
+		select {
+		case <-cancel:
+			cleanup()
+			close(msgChan)
+			close(cancel)
+		case <-ctx.Done():
+			cleanup()
+			close(msgChan)
+			// Leave cancel open: a later Cancel gets its own request back
+			// right away, rather than panicking on a closed channel.
+		}
+	}()
+
+	return extensions.NewBrokerChannelSubscription(msgChan, cancel)
+}
+
+// subscribe creates, connects and registers a consumer of topic and channel,
+// handling messages with the handler returned by newHandler.
+func (c *Controller) subscribe(ctx context.Context, topic, channel string, newHandler func(s *subscription) nsq.Handler) (*subscription, error) {
+	s, err := c.startSubscription(ctx, topic, channel, newHandler)
+	if c.logging {
+		c.logResult(ctx, "subscribing", err,
+			extensions.LogInfo{Key: "topic", Value: topic},
+			extensions.LogInfo{Key: "channel", Value: channel})
+	}
+
+	return s, err
+}
+
+func (c *Controller) startSubscription(ctx context.Context, topic, channel string, newHandler func(s *subscription) nsq.Handler) (*subscription, error) {
+	if c.closed.Load() {
+		return nil, ErrControllerClosed
+	}
+
+	if err := validateName("topic", topic); err != nil {
+		return nil, err
+	}
+	if err := validateName("channel", channel); err != nil {
+		return nil, err
+	}
+
+	cfg := *c.consumerConfig
+	if err := c.authSecretConfig(&cfg); err != nil {
+		return nil, err
+	}
+	if c.newBackoffStrategy != nil {
+		// Bound to this consumer config, see WithBackoffStrategy
+		_ = cfg.Set("backoff_strategy", c.newBackoffStrategy())
+	}
+	if c.adaptive != nil {
+		cfg.MaxInFlight = c.adaptive.initial(cfg.MaxInFlight)
+	}
+
+	consumer, err := nsq.NewConsumer(topic, channel, &cfg)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("trying to get list of topics from nsqlookupd: %w", err)
+	consumer.SetLogger(nsqLogger{logger: c.logger}, c.nsqLogLevel)
+
+	s := &subscription{
+		topic:       topic,
+		channel:     channel,
+		consumer:    consumer,
+		done:        make(chan struct{}),
+		maxInFlight: cfg.MaxInFlight,
 	}
+	consumer.AddConcurrentHandlers(newHandler(s), c.handlers)
 
-	type topicsBody struct {
-		Topics []string `json:"topics"`
+	connect := func() error { return c.connectConsumer(consumer) }
+	if c.lazyConnect {
+		// Connected in the background once registered
+		connect = func() error { return nil }
+	}
+	// Retries stop on Close too
+	retryCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go func() {
+		select {
+		case <-c.shutdown:
+			cancel(ErrControllerClosed)
+		case <-retryCtx.Done():
+		}
+	}()
+
+	if err := c.reconnect.retry(retryCtx, connect, func(attempt int, delay time.Duration, err error) {
+		c.logger.Warning(ctx, "connecting consumer failed, retrying",
+			extensions.LogInfo{Key: "topic", Value: topic},
+			extensions.LogInfo{Key: "channel", Value: channel},
+			extensions.LogInfo{Key: "attempt", Value: attempt},
+			extensions.LogInfo{Key: "delay", Value: delay},
+			extensions.LogInfo{Key: "error", Value: err.Error()})
+	}); err != nil {
+		consumer.Stop()
+		if retryCtx.Err() != nil {
+			err = context.Cause(retryCtx)
+		}
+		return nil, err
 	}
 
-	var body topicsBody
-	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
-		return nil, fmt.Errorf("trying to parse response from nsqlookupd: %w", err)
+	if err := c.register(s); err != nil {
+		consumer.Stop()
+		return nil, err
+	}
+	if c.lazyConnect {
+		go c.connectLazily(s)
+	}
+	if c.adaptive != nil {
+		go c.tuneMaxInFlight(s)
 	}
 
-	return body.Topics, nil
+	return s, nil
 }
 
-func messagesHandler(c chan<- extensions.BrokerMessage) nsq.Handler {
-	return nsq.HandlerFunc(func(message *nsq.Message) error {
-		headers := map[string][]byte{
-			"X-MsgID":     []byte(message.ID[:]),
-			"X-Attempts":  []byte(strconv.Itoa(int(message.Attempts))),
-			"X-Timestamp": []byte(strconv.Itoa(int(message.Timestamp))),
-		}
+// invalidOption records an error raised by an option.
+func (c *Controller) invalidOption(err error) {
+	c.optionsErr = errors.Join(c.optionsErr, err)
+}
+
+// subscriptionChannel splits topic from its '#channel' suffix. Without one,
+// the channel is the one mapped to topic, an ephemeral one or the queue group,
+// see WithTopicChannelMap.
+func (c *Controller) subscriptionChannel(topic string) (string, string) {
+	topic, channel := c.parseTopic(topic)
+	if channel != "" {
+		return topic, channel
+	}
+
+	if channel, ok := c.topicMap[topic]; ok {
+		return topic, channel
+	}
+	if c.ephemeral {
+		return topic, ephemeralChannelName(c.rand)
+	}
+
+	return topic, c.queueGroup
+}
+
+// ErrControllerClosed is returned when publishing or subscribing after Close.
+var ErrControllerClosed = errors.New("controller is closed")
+
+// ErrSubscriptionNotFound is returned by Unsubscribe, Pause and Resume when
+// there is no matching subscription.
+var ErrSubscriptionNotFound = errors.New("subscription not found")
+
+// Unsubscribe stops the consumers of topic. With a '#channel' suffix, only the
+// subscription to that channel is stopped, otherwise all subscriptions to the
+// topic are.
+//
+// Subscriptions stop receiving messages, but should still be canceled to
+// release them.
+func (c *Controller) Unsubscribe(topic string) error {
+	c.mu.Lock()
+	subs := c.matchSubscriptions(topic)
+	for _, s := range subs {
+		delete(c.subscriptions, s)
+	}
+	c.rebalanceMaxInFlight()
+	c.mu.Unlock()
 
-		c <- extensions.BrokerMessage{
-			Headers: headers,
-			Payload: message.Body,
+	if len(subs) == 0 {
+		return fmt.Errorf("%w: %s", ErrSubscriptionNotFound, topic)
+	}
+
+	c.stopSubscriptions(context.Background(), subs...)
+
+	return nil
+}
+
+// matchSubscriptions returns subscriptions to topic, only to its channel with
+// a '#channel' suffix. c.mu must be held.
+func (c *Controller) matchSubscriptions(topic string) []*subscription {
+	topic, channel := c.parseTopic(topic)
+
+	var subs []*subscription
+	for s := range c.subscriptions {
+		if s.topic == topic && (channel == "" || s.channel == channel) {
+			subs = append(subs, s)
 		}
+	}
 
-		return nil
-	})
+	return subs
+}
+
+// register tracks s, unless the controller is closed.
+func (c *Controller) register(s *subscription) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed.Load() {
+		return ErrControllerClosed
+	}
+
+	c.subscriptions[s] = struct{}{}
+	c.rebalanceMaxInFlight()
+
+	return nil
+}
+
+func (c *Controller) unregister(subs ...*subscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, s := range subs {
+		delete(c.subscriptions, s)
+	}
+	c.rebalanceMaxInFlight()
+}
+
+// Close closes everything related to the broker. Once called, publishing and
+// subscribing fail with ErrControllerClosed.
+//
+// Consumers are stopped first and given the drain timeout (30 seconds by
+// default, see WithDrainTimeout) to finish their in-flight messages, then the
+// producer is stopped. Consumers that didn't drain in time are logged.
+func (c *Controller) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.drainTimeout)
+	defer cancel()
+
+	if err := c.CloseWithContext(ctx); err != nil {
+		c.logger.Warning(ctx, "consumers did not drain in time",
+			extensions.LogInfo{Key: "timeout", Value: c.drainTimeout},
+			extensions.LogInfo{Key: "error", Value: err.Error()})
+	}
+}
+
+// CloseWithContext is like Close, but waits for consumers to drain until ctx
+// is done rather than for the drain timeout. The returned error lists
+// consumers that didn't drain in time, each wrapping ctx.Err().
+//
+// Only the first call to Close or CloseWithContext closes the controller,
+// later ones wait for it to complete, then return nil.
+func (c *Controller) CloseWithContext(ctx context.Context) error {
+	var err error
+	c.closeOnce.Do(func() { err = c.close(ctx) })
+
+	return err
+}
+
+func (c *Controller) close(ctx context.Context) error {
+	c.mu.Lock()
+	c.closed.Store(true)
+	close(c.shutdown)
+	subs := make([]*subscription, 0, len(c.subscriptions))
+	for s := range c.subscriptions {
+		subs = append(subs, s)
+	}
+	c.mu.Unlock()
+
+	err := c.drain(ctx, subs...)
+	c.stopProducers()
+
+	if c.logging {
+		// Consumers that didn't drain are left to the caller
+		c.logger.Info(ctx, "controller closed", extensions.LogInfo{Key: "subscriptions", Value: len(subs)})
+	}
+
+	return err
 }
 
-// Close closes everything related to the broker.
-func (c *Controller) Close() { c.p.Stop() }
+// stopSubscriptions stops consumers and waits until they finish draining or
+// the drain timeout fires, whichever comes first. A warning is logged for
+// every consumer that didn't finish.
+func (c *Controller) stopSubscriptions(ctx context.Context, subs ...*subscription) {
+	drainCtx, cancel := context.WithTimeout(context.Background(), c.drainTimeout)
+	defer cancel()
+
+	if err := c.drain(drainCtx, subs...); err != nil {
+		c.logger.Warning(ctx, "consumer did not drain in time",
+			extensions.LogInfo{Key: "timeout", Value: c.drainTimeout},
+			extensions.LogInfo{Key: "error", Value: err.Error()})
+	}
+}
 
-func nsqdConnect(c *nsq.Consumer, addr string) error       { return c.ConnectToNSQD(addr) }
-func nsqlookupdConnect(c *nsq.Consumer, addr string) error { return c.ConnectToNSQLookupd(addr) }
+// drain stops consumers, then waits until they finish draining or ctx is
+// done. The returned error lists consumers that didn't finish.
+func (c *Controller) drain(ctx context.Context, subs ...*subscription) error {
+	for _, s := range subs {
+		s.stopTransmitting()
+		s.consumer.Stop()
+	}
+
+	var errs []error
+	for _, s := range subs {
+		select {
+		case <-s.consumer.StopChan:
+			if c.logging {
+				c.logger.Info(ctx, "subscription stopped",
+					extensions.LogInfo{Key: "topic", Value: s.topic},
+					extensions.LogInfo{Key: "channel", Value: s.channel})
+			}
+		case <-ctx.Done():
+			errs = append(errs, fmt.Errorf("consumer of topic %q, channel %q did not drain: %w", s.topic, s.channel, ctx.Err()))
+		}
+	}
+
+	return errors.Join(errs...)
+}
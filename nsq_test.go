@@ -0,0 +1,345 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+	"github.com/nsqio/go-nsq"
+	"go.uber.org/goleak"
+)
+
+// testAddr is an nsqd address nothing listens on: controllers don't connect
+// until they publish or subscribe.
+const testAddr = "127.0.0.1:1"
+
+func newTestController(t *testing.T, options ...ControllerOption) *Controller {
+	t.Helper()
+
+	c, err := NewController(testAddr, options...)
+	if err != nil {
+		t.Fatalf("NewController() error = %v", err)
+	}
+	t.Cleanup(c.Close)
+
+	return c
+}
+
+// recordingLogger records the messages logged at every level.
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+var _ extensions.Logger = (*recordingLogger)(nil)
+
+func (l *recordingLogger) Info(_ context.Context, msg string, _ ...extensions.LogInfo) {
+	l.record(msg)
+}
+
+func (l *recordingLogger) Warning(_ context.Context, msg string, _ ...extensions.LogInfo) {
+	l.record(msg)
+}
+
+func (l *recordingLogger) Error(_ context.Context, msg string, _ ...extensions.LogInfo) {
+	l.record(msg)
+}
+
+func (l *recordingLogger) record(msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.messages = append(l.messages, msg)
+}
+
+// count returns how many messages containing substr were logged.
+func (l *recordingLogger) count(substr string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := 0
+	for _, msg := range l.messages {
+		if strings.Contains(msg, substr) {
+			n++
+		}
+	}
+
+	return n
+}
+
+func TestSubscriptionChannel(t *testing.T) {
+	tests := []struct {
+		name        string
+		options     []ControllerOption
+		topic       string
+		wantTopic   string
+		wantChannel string
+		// wantEphemeral expects any ephemeral channel rather than wantChannel
+		wantEphemeral bool
+	}{
+		{
+			name:        "default channel",
+			topic:       "orders",
+			wantTopic:   "orders",
+			wantChannel: defaultChannelName,
+		},
+		{
+			name:        "queue group",
+			options:     []ControllerOption{WithQueueGroup("workers")},
+			topic:       "orders",
+			wantTopic:   "orders",
+			wantChannel: "workers",
+		},
+		{
+			name:        "suffix",
+			topic:       "orders#audit",
+			wantTopic:   "orders",
+			wantChannel: "audit",
+		},
+		{
+			name:        "suffix over queue group",
+			options:     []ControllerOption{WithQueueGroup("workers")},
+			topic:       "orders#audit",
+			wantTopic:   "orders",
+			wantChannel: "audit",
+		},
+		{
+			name:        "suffix over topic map",
+			options:     []ControllerOption{WithTopicChannelMap(map[string]string{"orders": "billing"})},
+			topic:       "orders#audit",
+			wantTopic:   "orders",
+			wantChannel: "audit",
+		},
+		{
+			name: "topic map over ephemeral and queue group",
+			options: []ControllerOption{
+				WithTopicChannelMap(map[string]string{"orders": "billing"}),
+				WithEphemeralChannel(),
+				WithQueueGroup("workers"),
+			},
+			topic:       "orders",
+			wantTopic:   "orders",
+			wantChannel: "billing",
+		},
+		{
+			name: "ephemeral over queue group",
+			options: []ControllerOption{
+				WithTopicChannelMap(map[string]string{"payments": "billing"}),
+				WithEphemeralChannel(),
+				WithQueueGroup("workers"),
+			},
+			topic:         "orders",
+			wantTopic:     "orders",
+			wantEphemeral: true,
+		},
+		{
+			name: "queue group for unmapped topics",
+			options: []ControllerOption{
+				WithTopicChannelMap(map[string]string{"payments": "billing"}),
+				WithQueueGroup("workers"),
+			},
+			topic:       "orders",
+			wantTopic:   "orders",
+			wantChannel: "workers",
+		},
+		{
+			name:        "default channel for unmapped topics",
+			options:     []ControllerOption{WithTopicChannelMap(map[string]string{"payments": "billing"})},
+			topic:       "orders",
+			wantTopic:   "orders",
+			wantChannel: defaultChannelName,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestController(t, tt.options...)
+
+			topic, channel := c.subscriptionChannel(tt.topic)
+			if tt.wantEphemeral {
+				if topic != tt.wantTopic || !strings.HasSuffix(channel, ephemeralSuffix) {
+					t.Errorf("subscriptionChannel(%q) = %q, %q, want %q, an ephemeral channel",
+						tt.topic, topic, channel, tt.wantTopic)
+				}
+				return
+			}
+			if topic != tt.wantTopic || channel != tt.wantChannel {
+				t.Errorf("subscriptionChannel(%q) = %q, %q, want %q, %q",
+					tt.topic, topic, channel, tt.wantTopic, tt.wantChannel)
+			}
+		})
+	}
+}
+
+// silentServer accepts connections and never answers, like an nsqd too slow
+// to respond, until stop is called.
+func silentServer(t *testing.T) (addr string, stop func()) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestPublishDeadline(t *testing.T) {
+	addr, stop := silentServer(t)
+	c, err := NewController(addr)
+	if err != nil {
+		stop()
+		t.Fatalf("NewController() error = %v", err)
+	}
+	t.Cleanup(c.Close)
+	// Before closing the controller, so its producer isn't left waiting for
+	// an answer
+	t.Cleanup(stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = c.Publish(ctx, "orders", extensions.BrokerMessage{Payload: []byte("hello")})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Publish() took %v, want it to return once the deadline is exceeded", elapsed)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, ErrPublishTimeout) {
+		t.Errorf("Publish() error = %v, want %v and %v", err, context.DeadlineExceeded, ErrPublishTimeout)
+	}
+}
+
+func TestSubscribeWhileClosing(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	c, err := NewController(testAddr, WithLazyConnect())
+	if err != nil {
+		t.Fatalf("NewController() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := c.Subscribe(ctx, "orders")
+			if err != nil && !errors.Is(err, ErrControllerClosed) {
+				t.Errorf("Subscribe() error = %v, want nil or %v", err, ErrControllerClosed)
+			}
+		}()
+	}
+	c.Close()
+	wg.Wait()
+
+	if _, err := c.Subscribe(ctx, "orders"); !errors.Is(err, ErrControllerClosed) {
+		t.Errorf("Subscribe() after Close error = %v, want %v", err, ErrControllerClosed)
+	}
+	if err := c.Publish(ctx, "orders", extensions.BrokerMessage{}); !errors.Is(err, ErrControllerClosed) {
+		t.Errorf("Publish() after Close error = %v, want %v", err, ErrControllerClosed)
+	}
+	// Subscriptions stop with their context
+	cancel()
+}
+
+func TestOrderedDelivery(t *testing.T) {
+	cfg := nsq.NewConfig()
+	cfg.MaxInFlight = 16
+
+	c := newTestController(t,
+		WithOrderedDelivery(),
+		WithConsumerConfig(cfg),
+		WithConcurrentHandlers(4),
+		WithGlobalMaxInFlight(32))
+
+	if c.handlers != 1 {
+		t.Errorf("handlers = %d, want 1", c.handlers)
+	}
+	if c.consumerConfig.MaxInFlight != 1 {
+		t.Errorf("MaxInFlight = %d, want 1", c.consumerConfig.MaxInFlight)
+	}
+	if c.globalMaxInFlight != 0 {
+		t.Errorf("globalMaxInFlight = %d, want 0", c.globalMaxInFlight)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	logger := &recordingLogger{}
+	c, err := NewController(testAddr, WithLogger(logger))
+	if err != nil {
+		t.Fatalf("NewController() error = %v", err)
+	}
+
+	c.Close()
+	if err := c.CloseWithContext(context.Background()); err != nil {
+		t.Errorf("CloseWithContext() after Close error = %v, want nil", err)
+	}
+	c.Close()
+
+	if n := logger.count("controller closed"); n != 1 {
+		t.Errorf("controller closed %d times, want once", n)
+	}
+	// Logged by go-nsq
+	if n := logger.count(") stopping"); n != 1 {
+		t.Errorf("producer stopped %d times, want once", n)
+	}
+	if err := c.Publish(context.Background(), "orders", extensions.BrokerMessage{}); !errors.Is(err, ErrControllerClosed) {
+		t.Errorf("Publish() after Close error = %v, want %v", err, ErrControllerClosed)
+	}
+}
+
+func TestSubscribeContextCanceled(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	c, err := NewController(testAddr, WithLazyConnect())
+	if err != nil {
+		t.Fatalf("NewController() error = %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := c.Subscribe(ctx, "orders")
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	cancel()
+
+	select {
+	case _, ok := <-sub.MessagesChannel():
+		if ok {
+			t.Fatal("received a message, want the channel closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("messages channel not closed after the context was canceled")
+	}
+	if subs := c.Subscriptions(); len(subs) != 0 {
+		t.Errorf("Subscriptions() = %v, want none", subs)
+	}
+	// Canceling afterwards doesn't stop the consumer again
+	sub.Cancel(context.Background())
+}
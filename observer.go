@@ -0,0 +1,63 @@
+package nsq
+
+import "github.com/nsqio/go-nsq"
+
+// DeliveryOutcome is how a received message ended up, see
+// WithDeliveryObserver.
+type DeliveryOutcome int
+
+const (
+	// DeliveryFinished means the message was processed, NSQ won't deliver it
+	// again.
+	DeliveryFinished DeliveryOutcome = iota + 1
+	// DeliveryRequeued means the message will be delivered again.
+	DeliveryRequeued
+	// DeliveryFailed means the message exceeded MaxAttempts (see
+	// WithMaxAttempts), and was given up.
+	DeliveryFailed
+)
+
+func (o DeliveryOutcome) String() string {
+	switch o {
+	case DeliveryFinished:
+		return "finished"
+	case DeliveryRequeued:
+		return "requeued"
+	case DeliveryFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// DeliveryResult describes how a received message ended up.
+type DeliveryResult struct {
+	Outcome DeliveryOutcome
+	// ID of the message, as in HeaderMessageID.
+	ID string
+	// Attempts is how many times the message has been delivered, this one
+	// included.
+	Attempts uint16
+}
+
+// WithDeliveryObserver sets a function called with the outcome of every
+// received message, once it's decided: when the handler returns with Subscribe,
+// when Ack or Requeue is called with SubscribeDelivery.
+//
+// fn runs synchronously on the goroutine deciding it, so it should be fast.
+func WithDeliveryObserver(fn func(topic, channel string, result DeliveryResult)) ControllerOption {
+	return func(controller *Controller) { controller.deliveryObserver = fn }
+}
+
+// observeDelivery calls the delivery observer, if set.
+func (c *Controller) observeDelivery(topic, channel string, message *nsq.Message, outcome DeliveryOutcome) {
+	if c.deliveryObserver == nil {
+		return
+	}
+
+	c.deliveryObserver(topic, channel, DeliveryResult{
+		Outcome:  outcome,
+		ID:       string(message.ID[:]),
+		Attempts: message.Attempts,
+	})
+}
@@ -0,0 +1,62 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+)
+
+// PanicPolicy is what Consume does with a message its handler panicked on.
+type PanicPolicy int
+
+const (
+	// PanicRequeue requeues the message like a handler error, so it's
+	// delivered again until MaxAttempts.
+	PanicRequeue PanicPolicy = iota
+	// PanicFinish finishes the message, dropping it.
+	PanicFinish
+)
+
+// errHandlerPanicked requeues messages whose handler panicked, see
+// PanicRequeue.
+var errHandlerPanicked = errors.New("handler panicked")
+
+// WithPanicPolicy sets what Consume does when its handler panics, after
+// recovering and logging the panic with its stack. Defaults to PanicRequeue.
+func WithPanicPolicy(p PanicPolicy) ControllerOption {
+	if p != PanicRequeue && p != PanicFinish {
+		return withError(fmt.Errorf("invalid panic policy %d", p))
+	}
+
+	return func(controller *Controller) { controller.panicPolicy = p }
+}
+
+// handle calls handler with d, recovering from panics: they're logged, then
+// turned into an error with PanicRequeue, or success with PanicFinish.
+func (c *Controller) handle(d *Delivery, bm extensions.BrokerMessage,
+	handler func(context.Context, extensions.BrokerMessage) error,
+) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		c.logger.Error(d.Context(), "handler panicked",
+			extensions.LogInfo{Key: "topic", Value: d.handler.sub.topic},
+			extensions.LogInfo{Key: "channel", Value: d.handler.sub.channel},
+			extensions.LogInfo{Key: "message_id", Value: d.ID},
+			extensions.LogInfo{Key: "panic", Value: fmt.Sprint(r)},
+			extensions.LogInfo{Key: "stack", Value: string(debug.Stack())})
+
+		err = nil
+		if c.panicPolicy == PanicRequeue {
+			err = errHandlerPanicked
+		}
+	}()
+
+	return handler(d.Context(), bm)
+}
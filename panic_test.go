@@ -0,0 +1,37 @@
+package nsq
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+)
+
+func TestPanicPolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		options      []ControllerOption
+		wantFinished bool
+	}{
+		{name: "default requeues"},
+		{name: "requeue", options: []ControllerOption{WithPanicPolicy(PanicRequeue)}},
+		{name: "finish", options: []ControllerOption{WithPanicPolicy(PanicFinish)}, wantFinished: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &recordingLogger{}
+			c := newTestController(t, append(tt.options, WithLogger(logger))...)
+			d, delegate := testDelivery(c)
+
+			c.process(d, func(context.Context, extensions.BrokerMessage) error { panic("boom") })
+
+			if delegate.finished != tt.wantFinished || delegate.requeued == tt.wantFinished {
+				t.Errorf("finished %v, requeued %v, want finished %v", delegate.finished, delegate.requeued, tt.wantFinished)
+			}
+			if n := logger.count("handler panicked"); n != 1 {
+				t.Errorf("logged the panic %d times, want once", n)
+			}
+		})
+	}
+}
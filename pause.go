@@ -0,0 +1,48 @@
+package nsq
+
+import "fmt"
+
+// Pause stops delivering messages to the subscriptions of topic, without
+// stopping them: messages already delivered are still transmitted. With a
+// '#channel' suffix, only the subscription to that channel is paused.
+//
+// It works by setting the consumers MaxInFlight to 0, until Resume is called.
+func (c *Controller) Pause(topic string) error {
+	return c.setPaused(topic, true)
+}
+
+// Resume restores delivering messages to subscriptions paused with Pause.
+func (c *Controller) Resume(topic string) error {
+	return c.setPaused(topic, false)
+}
+
+func (c *Controller) setPaused(topic string, paused bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	subs := c.matchSubscriptions(topic)
+	if len(subs) == 0 {
+		return fmt.Errorf("%w: %s", ErrSubscriptionNotFound, topic)
+	}
+
+	for _, s := range subs {
+		s.paused = paused
+	}
+
+	// Paused subscriptions give their share of the global max in flight to
+	// others, see WithGlobalMaxInFlight.
+	c.rebalanceMaxInFlight()
+
+	for _, s := range subs {
+		n := 0
+		if !paused {
+			n = c.maxInFlight()
+			if c.adaptive != nil {
+				n = s.maxInFlight
+			}
+		}
+		s.consumer.ChangeMaxInFlight(n)
+	}
+
+	return nil
+}
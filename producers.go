@@ -0,0 +1,176 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+	"github.com/nsqio/go-nsq"
+)
+
+// WithProducerFailover adds producers to other nsqd nodes. Publishing spreads
+// messages across all producers in turn and, when one fails, tries the next
+// ones before returning an error.
+func WithProducerFailover(addrs []string) ControllerOption {
+	return func(controller *Controller) {
+		controller.failoverAddrs = append(controller.failoverAddrs, addrs...)
+	}
+}
+
+// WithShardedProducers makes Publish send messages to the nsqd address shard
+// returns for their topic, through a producer per address created on first
+// use. An empty address means the controller one. Deterministic mapping keeps
+// each topic on a single nsqd, spreading the load of distinct topics.
+//
+// It can't be combined with WithProducerFailover, which spreads every topic
+// across nodes: NewController returns an error if both are set.
+func WithShardedProducers(shard func(topic string) string) ControllerOption {
+	return func(controller *Controller) { controller.shard = shard }
+}
+
+func (c *Controller) newProducer(addr string) (*nsq.Producer, error) {
+	p, err := nsq.NewProducer(addr, c.producerConfig)
+	if err != nil {
+		return nil, err
+	}
+	p.SetLogger(nsqLogger{logger: c.logger}, c.nsqLogLevel)
+
+	return p, nil
+}
+
+// nextProducers returns the producers to publish on topic with: the shard
+// one with WithShardedProducers, otherwise all producers, starting from the
+// next one in turn.
+func (c *Controller) nextProducers(topic string) ([]*nsq.Producer, error) {
+	if c.shard != nil {
+		p, err := c.shardProducer(topic)
+		if err != nil {
+			return nil, err
+		}
+		return []*nsq.Producer{p}, nil
+	}
+
+	c.producersMu.RLock()
+	defer c.producersMu.RUnlock()
+
+	if len(c.producers) == 1 {
+		return []*nsq.Producer{c.producers[0]}, nil
+	}
+
+	start := int(c.nextProducer.Add(1) % uint64(len(c.producers)))
+
+	return append(c.producers[start:len(c.producers):len(c.producers)], c.producers[:start]...), nil
+}
+
+// shardProducer returns the producer to the nsqd topic is sharded to,
+// creating it if needed.
+func (c *Controller) shardProducer(topic string) (*nsq.Producer, error) {
+	addr := c.shard(topic)
+	find := func() *nsq.Producer {
+		if addr == "" {
+			return c.producers[0]
+		}
+		if i := slices.IndexFunc(c.producers, func(p *nsq.Producer) bool { return p.String() == addr }); i >= 0 {
+			return c.producers[i]
+		}
+		return nil
+	}
+
+	c.producersMu.RLock()
+	p := find()
+	c.producersMu.RUnlock()
+	if p != nil {
+		return p, nil
+	}
+
+	c.producersMu.Lock()
+	defer c.producersMu.Unlock()
+
+	if c.closed.Load() {
+		return nil, ErrControllerClosed
+	}
+	if p := find(); p != nil {
+		return p, nil
+	}
+
+	p, err := c.newProducer(addr)
+	if err != nil {
+		return nil, fmt.Errorf("creating producer to %s for topic %q: %w", addr, topic, err)
+	}
+	c.producers = append(c.producers, p)
+
+	return p, nil
+}
+
+// allProducers returns a copy of the producers.
+func (c *Controller) allProducers() []*nsq.Producer {
+	c.producersMu.RLock()
+	defer c.producersMu.RUnlock()
+
+	return append([]*nsq.Producer(nil), c.producers...)
+}
+
+// rebuildProducer replaces p, with a broken connection, by a new producer to
+// the same nsqd. If p was already replaced, its replacement is returned.
+func (c *Controller) rebuildProducer(ctx context.Context, p *nsq.Producer) (*nsq.Producer, error) {
+	c.producersMu.Lock()
+	defer c.producersMu.Unlock()
+
+	if c.closed.Load() {
+		return nil, ErrControllerClosed
+	}
+
+	i := slices.Index(c.producers, p)
+	if i < 0 {
+		// Already replaced
+		i = slices.IndexFunc(c.producers, func(current *nsq.Producer) bool { return current.String() == p.String() })
+		if i < 0 {
+			return nil, fmt.Errorf("producer %s not found", p)
+		}
+		return c.producers[i], nil
+	}
+
+	rebuilt, err := c.newProducer(p.String())
+	if err != nil {
+		return nil, err
+	}
+	c.producers[i] = rebuilt
+	// Publications in progress with p fail, then retry with rebuilt
+	go p.Stop()
+
+	c.logger.Warning(ctx, "nsqd connection lost, producer rebuilt",
+		extensions.LogInfo{Key: "address", Value: p.String()})
+
+	return rebuilt, nil
+}
+
+// connectionLost tells whether err comes from a connection to nsqd that broke
+// while publishing, or a producer stopped by a concurrent rebuild. Failing to
+// dial isn't: a new producer wouldn't do better.
+func connectionLost(err error) bool {
+	return errors.Is(err, nsq.ErrNotConnected) || errors.Is(err, nsq.ErrStopped)
+}
+
+func (c *Controller) stopProducers() {
+	c.producersMu.Lock()
+	defer c.producersMu.Unlock()
+
+	for _, p := range c.producers {
+		p.Stop()
+	}
+}
+
+// ping pings nsqd with p, giving up when ctx is done.
+func ping(ctx context.Context, p *nsq.Producer) error {
+	done := make(chan error, 1)
+	go func() { done <- p.Ping() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
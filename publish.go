@@ -0,0 +1,320 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+	"github.com/nsqio/go-nsq"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// maxDeferDelay is the default --max-req-timeout of nsqd, which also bounds
+	// deferred publishing.
+	maxDeferDelay = 60 * time.Minute
+
+	// maxMessageSize is the default --max-msg-size of nsqd.
+	maxMessageSize = 1024 * 1024
+	// maxBodySize is the default --max-body-size of nsqd, bounding batches.
+	maxBodySize = 5 * 1024 * 1024
+)
+
+// WithPublishRetry makes publishing retry up to maxAttempts times in total
+// when nsqd can't be reached or times out (see ErrNotConnected and
+// ErrPublishTimeout), with an exponential backoff from baseDelay up to 2
+// minutes, jittered (see WithRetryJitter). Other errors, such as
+// ErrPublishRejected, fail right away. Retries stop when the publish context
+// is done, and are logged as warnings.
+func WithPublishRetry(maxAttempts int, baseDelay time.Duration) ControllerOption {
+	if maxAttempts < 1 {
+		return withError(fmt.Errorf("invalid publish attempts %d: must be at least 1", maxAttempts))
+	}
+	if baseDelay < 0 {
+		return withError(fmt.Errorf("invalid publish retry delay %v: must not be negative", baseDelay))
+	}
+
+	return func(controller *Controller) {
+		controller.publishRetry = backoff{
+			maxRetries: maxAttempts - 1,
+			baseDelay:  baseDelay,
+			jitter:     JitterEqual,
+			retryable:  retryablePublishError,
+		}
+	}
+}
+
+// WithMaxMessageSize makes publishing fail with ErrMessageTooLarge, without
+// sending anything, when a message body is larger than n bytes, envelope
+// included. It should match nsqd --max-msg-size (1 MiB by default). Zero, the
+// default, disables the check, except for PublishBatch which still checks
+// nsqd's default: one message too large would get the whole batch rejected.
+func WithMaxMessageSize(n int) ControllerOption {
+	if n < 0 {
+		return withError(fmt.Errorf("invalid max message size %d: must not be negative", n))
+	}
+
+	return func(controller *Controller) { controller.messageSizeLimit = n }
+}
+
+// WithPublishValidator sets a function validating payloads before they're
+// published, e.g. against the AsyncAPI schema of topic. An error aborts the
+// publication and is returned as is.
+//
+// It runs synchronously in every publication, so it should be fast.
+func WithPublishValidator(validate func(topic string, payload []byte) error) ControllerOption {
+	return func(controller *Controller) { controller.publishValidator = validate }
+}
+
+// validatePayload runs the publish validator, if set.
+func (c *Controller) validatePayload(topic string, payload []byte) error {
+	if c.publishValidator == nil {
+		return nil
+	}
+
+	return c.publishValidator(topic, payload)
+}
+
+// PublishDeferred publishes a message that nsqd delivers to consumers only
+// after delay.
+func (c *Controller) PublishDeferred(ctx context.Context, topic string, delay time.Duration, bm extensions.BrokerMessage) error {
+	if delay < 0 || delay > maxDeferDelay {
+		return fmt.Errorf("invalid deferred publish delay %v: must be between 0 and %v", delay, maxDeferDelay)
+	}
+
+	topic = c.publishTopic(topic)
+	if err := validateName("topic", topic); err != nil {
+		return err
+	}
+	if err := c.validatePayload(topic, bm.Payload); err != nil {
+		return err
+	}
+
+	_, err := c.publishMessages(ctx, topic, []extensions.BrokerMessage{bm}, false,
+		func(p *nsq.Producer, bodies [][]byte, done chan *nsq.ProducerTransaction) error {
+			return p.DeferredPublishAsync(topic, delay, bodies[0], done)
+		})
+
+	return err
+}
+
+// PublishBatch publishes messages at once, in a single round trip to nsqd.
+// An empty batch publishes nothing, and the whole batch must fit nsqd default
+// max body size of 5 MiB.
+//
+// Like with Publish, headers are sent only if an envelope codec is set with
+// WithEnvelopeCodec.
+func (c *Controller) PublishBatch(ctx context.Context, topic string, msgs []extensions.BrokerMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// nsqd drops connections sending empty batches
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	topic = c.publishTopic(topic)
+	if err := validateName("topic", topic); err != nil {
+		return err
+	}
+	for i, bm := range msgs {
+		if err := c.validatePayload(topic, bm.Payload); err != nil {
+			return fmt.Errorf("message %d: %w", i, err)
+		}
+	}
+
+	_, err := c.publishMessages(ctx, topic, msgs, true,
+		func(p *nsq.Producer, bodies [][]byte, done chan *nsq.ProducerTransaction) error {
+			return p.MultiPublishAsync(topic, bodies, done)
+		})
+
+	return err
+}
+
+// encodeAll encodes msgs, see encode. A batch must fit nsqd default max
+// message and body sizes.
+func (c *Controller) encodeAll(msgs []extensions.BrokerMessage, batch bool) ([][]byte, error) {
+	if !batch {
+		body, err := c.encode(msgs[0])
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{body}, nil
+	}
+
+	bodies := make([][]byte, len(msgs))
+	size := 4
+	for i, bm := range msgs {
+		body, err := c.encode(bm)
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", i, err)
+		}
+		if c.messageSizeLimit == 0 && len(body) > maxMessageSize {
+			return nil, fmt.Errorf("message %d: %w: %d bytes, more than nsqd default max of %d bytes",
+				i, ErrMessageTooLarge, len(body), maxMessageSize)
+		}
+		bodies[i] = body
+		// Every body is prefixed by its size, after the messages count
+		size += 4 + len(body)
+	}
+	if size > maxBodySize {
+		return nil, fmt.Errorf("%w: batch of %d bytes, more than nsqd default max of %d bytes",
+			ErrMessageTooLarge, size, maxBodySize)
+	}
+
+	return bodies, nil
+}
+
+// PublishRouted publishes a message like Publish, to the topic route returns
+// for it, e.g. from one of its headers. Errors from route are returned as is.
+func (c *Controller) PublishRouted(ctx context.Context, bm extensions.BrokerMessage,
+	route func(extensions.BrokerMessage) (string, error),
+) error {
+	topic, err := route(bm)
+	if err != nil {
+		return err
+	}
+
+	return c.Publish(ctx, topic, bm)
+}
+
+// PublishFanout publishes a message like Publish to each of topics, at once.
+// The returned error joins the failure of every topic.
+//
+// It isn't atomic, as nsqd can't publish to several topics at once: when some
+// topics fail, the others may still have received the message.
+func (c *Controller) PublishFanout(ctx context.Context, topics []string, bm extensions.BrokerMessage) error {
+	errs := make([]error, len(topics))
+
+	var g errgroup.Group
+	for i, topic := range topics {
+		i, topic := i, topic
+		g.Go(func() error {
+			if err := c.Publish(ctx, topic, bm); err != nil {
+				errs[i] = fmt.Errorf("topic %q: %w", topic, err)
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	return errors.Join(errs...)
+}
+
+// PublishAsync publishes a message like Publish, but without waiting for nsqd
+// acknowledgement. The returned channel gets the result of the publication.
+// With WithMaxConcurrentPublishes, it blocks until a slot is free, or ctx is
+// done.
+//
+// Use Flush to wait for all asynchronous publications to complete.
+func (c *Controller) PublishAsync(ctx context.Context, topic string, bm extensions.BrokerMessage) <-chan error {
+	result := make(chan error, 1)
+
+	if c.publishSlots != nil {
+		if err := c.publishSlots.acquire(ctx); err != nil {
+			result <- err
+			return result
+		}
+		// The slot is held for the whole publication
+		ctx = context.WithValue(ctx, publishSlotKey{}, true)
+	}
+
+	c.pending.add()
+	go func() {
+		defer c.pending.done()
+		if c.publishSlots != nil {
+			defer c.publishSlots.release()
+		}
+		result <- c.Publish(ctx, topic, bm)
+	}()
+
+	return result
+}
+
+// WithMaxConcurrentPublishes bounds to n the transactions awaiting nsqd
+// acknowledgement, publications without waiting included (see PublishAsync).
+// Publishing then blocks until a transaction completes, or the publish
+// context is done, making bursts wait rather than pile up in memory.
+//
+// By default, it's unbounded: the lowest latency, but bursts of PublishAsync
+// allocate as many pending transactions.
+func WithMaxConcurrentPublishes(n int) ControllerOption {
+	if n < 1 {
+		return withError(fmt.Errorf("invalid max concurrent publishes %d: must be at least 1", n))
+	}
+
+	return func(controller *Controller) { controller.publishSlots = make(semaphore, n) }
+}
+
+// publishSlotKey marks contexts of publications already holding a slot, see
+// PublishAsync.
+type publishSlotKey struct{}
+
+// semaphore bounds concurrent operations to its capacity.
+type semaphore chan struct{}
+
+// acquire takes a slot, waiting for one to be free or ctx to be done.
+func (s semaphore) acquire(ctx context.Context) error {
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s semaphore) release() { <-s }
+
+// Flush waits until every publication in progress completes, including those
+// whose Publish context was done before nsqd acknowledged them. It returns
+// ctx.Err() if ctx is done first.
+func (c *Controller) Flush(ctx context.Context) error {
+	return c.pending.wait(ctx)
+}
+
+// pendingPublishes counts publications in progress.
+type pendingPublishes struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{}
+}
+
+func (p *pendingPublishes) add() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.n == 0 {
+		p.idle = make(chan struct{})
+	}
+	p.n++
+}
+
+func (p *pendingPublishes) done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.n--; p.n == 0 {
+		close(p.idle)
+	}
+}
+
+// wait waits until there is no publication in progress or ctx is done.
+func (p *pendingPublishes) wait(ctx context.Context) error {
+	p.mu.Lock()
+	if p.n == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	idle := p.idle
+	p.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,190 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+	"github.com/nsqio/go-nsq"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// instantClock doesn't wait, and records the delays it was asked for.
+type instantClock struct {
+	mu     sync.Mutex
+	delays []time.Duration
+}
+
+func (c *instantClock) Now() time.Time { return time.Now() }
+
+func (c *instantClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	c.delays = append(c.delays, d)
+	c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	ch <- time.Now()
+
+	return ch
+}
+
+// failingCall returns a producer call failing with err the given number of
+// times, then succeeding, and the count of calls made.
+func failingCall(failures int, err error) (func(p *nsq.Producer, done chan *nsq.ProducerTransaction) error, *int) {
+	calls := 0
+	return func(_ *nsq.Producer, done chan *nsq.ProducerTransaction) error {
+		calls++
+		if calls <= failures {
+			return err
+		}
+		done <- &nsq.ProducerTransaction{}
+		return nil
+	}, &calls
+}
+
+func TestPublishRetry(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	tests := []struct {
+		name      string
+		failures  int
+		err       error
+		wantErr   error
+		wantCalls int
+	}{
+		{name: "recovers", failures: 2, err: dialErr, wantCalls: 3},
+		{name: "exhausted", failures: 5, err: dialErr, wantErr: ErrNotConnected, wantCalls: 4},
+		{name: "not retryable", failures: 5, err: nsq.ErrProtocol{Reason: "E_BAD_TOPIC"}, wantErr: ErrPublishRejected, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clk, logger := &instantClock{}, &recordingLogger{}
+			c := newTestController(t, WithPublishRetry(4, 10*time.Millisecond), withClock(clk), WithLogger(logger))
+
+			call, calls := failingCall(tt.failures, tt.err)
+			err := c.send(context.Background(), "orders", call)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("send() error = %v, want %v", err, tt.wantErr)
+			}
+			if *calls != tt.wantCalls {
+				t.Errorf("send() made %d calls, want %d", *calls, tt.wantCalls)
+			}
+
+			retries := tt.wantCalls - 1
+			if len(clk.delays) != retries {
+				t.Errorf("waited %d times, want %d", len(clk.delays), retries)
+			}
+			if n := logger.count("publishing failed, retrying"); n != retries {
+				t.Errorf("logged %d retries, want %d", n, retries)
+			}
+		})
+	}
+}
+
+// countingTracerProvider counts the spans started by its tracers.
+type countingTracerProvider struct {
+	noop.TracerProvider
+	spans atomic.Int32
+}
+
+func (p *countingTracerProvider) Tracer(string, ...trace.TracerOption) trace.Tracer {
+	return countingTracer{spans: &p.spans}
+}
+
+type countingTracer struct {
+	noop.Tracer
+	spans *atomic.Int32
+}
+
+func (t countingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	t.spans.Add(1)
+	return t.Tracer.Start(ctx, name, opts...)
+}
+
+func TestPublishInstrumentation(t *testing.T) {
+	msgs := []extensions.BrokerMessage{{Payload: []byte("first")}, {Payload: []byte("second")}}
+
+	tests := []struct {
+		name    string
+		publish func(ctx context.Context, c *Controller) error
+		want    int
+	}{
+		{
+			name:    "publish",
+			publish: func(ctx context.Context, c *Controller) error { return c.Publish(ctx, "orders", msgs[0]) },
+			want:    1,
+		},
+		{
+			name: "deferred",
+			publish: func(ctx context.Context, c *Controller) error {
+				return c.PublishDeferred(ctx, "orders", time.Second, msgs[0])
+			},
+			want: 1,
+		},
+		{
+			name:    "batch",
+			publish: func(ctx context.Context, c *Controller) error { return c.PublishBatch(ctx, "orders", msgs) },
+			want:    2,
+		},
+	}
+
+	spanContext := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x0a, 0x1b, 0x2c, 0x3d, 0x4e, 0x5f, 0x60, 0x71, 0x82, 0x93, 0xa4, 0xb5, 0xc6, 0xd7, 0xe8, 0xf9},
+		SpanID:     trace.SpanID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), spanContext)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, nsqd := newFakeNSQD(t)
+			tp := &countingTracerProvider{}
+			c, err := NewController(addr, WithEnvelopeCodec(JSONEnvelope{}), WithTracerProvider(tp))
+			if err != nil {
+				t.Fatalf("NewController() error = %v", err)
+			}
+			t.Cleanup(c.Close)
+
+			if err := tt.publish(ctx, c); err != nil {
+				t.Fatalf("publishing error = %v", err)
+			}
+
+			if n := tp.spans.Load(); n != 1 {
+				t.Errorf("started %d spans, want 1", n)
+			}
+			if n := c.Stats().Published["orders"]; n != uint64(tt.want) {
+				t.Errorf("Stats().Published = %d, want %d", n, tt.want)
+			}
+
+			published := nsqd.published()
+			if len(published) != 1 {
+				t.Fatalf("nsqd received %d publications, want 1", len(published))
+			}
+			bodies := [][]byte{published[0].body}
+			if published[0].name == "MPUB" {
+				bodies = mpubBodies(published[0].body)
+			}
+			if len(bodies) != tt.want {
+				t.Fatalf("nsqd received %d messages, want %d", len(bodies), tt.want)
+			}
+			for i, body := range bodies {
+				bm, err := JSONEnvelope{}.Decode(body)
+				if err != nil {
+					t.Fatalf("message %d: Decode() error = %v", i, err)
+				}
+				if traceparent := string(bm.Headers["traceparent"]); !strings.Contains(traceparent, spanContext.TraceID().String()) {
+					t.Errorf("message %d: traceparent = %q, want trace ID %s", i, traceparent, spanContext.TraceID())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package nsq
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+)
+
+const (
+	// HeaderCorrelationID is set by Request on requests, and must be copied by
+	// responders on their replies.
+	HeaderCorrelationID = "X-Correlation-ID"
+
+	// HeaderReplyTo is set by Request on requests to the topic it expects the
+	// reply on.
+	HeaderReplyTo = "X-Reply-To"
+)
+
+// ErrEnvelopeRequired is returned by features relying on headers when no
+// envelope codec is set with WithEnvelopeCodec.
+var ErrEnvelopeRequired = errors.New("an envelope codec is required")
+
+// replyIdleTimeout is how long a reply subscription outlives its last
+// request, so the next ones reuse it rather than racing a new consumer on the
+// same channel with the stopping one.
+const replyIdleTimeout = 10 * time.Second
+
+// replyRouter hands replies received on a topic to the requests awaiting
+// them.
+type replyRouter struct {
+	topic   string
+	sub     extensions.BrokerChannelSubscription
+	waiters map[string]chan extensions.BrokerMessage
+	idle    *time.Timer // stops sub once no request awaits it, see forgetReply
+}
+
+// Request publishes bm on requestTopic and waits for the reply with the same
+// correlation ID on replyTopic, until ctx is done. It needs an envelope codec.
+//
+// Concurrent requests share a single subscription per reply topic, which is
+// canceled once no request has awaited it for 10 seconds. As any subscription, replyTopic
+// may have a '#channel' suffix: it should be unique to this process, so other
+// instances don't get its replies.
+func (c *Controller) Request(ctx context.Context, requestTopic string, bm extensions.BrokerMessage, replyTopic string) (extensions.BrokerMessage, error) {
+	if c.envelope == nil {
+		return extensions.BrokerMessage{}, ErrEnvelopeRequired
+	}
+
+	id, err := newCorrelationID()
+	if err != nil {
+		return extensions.BrokerMessage{}, err
+	}
+
+	reply, err := c.awaitReply(ctx, replyTopic, id)
+	if err != nil {
+		return extensions.BrokerMessage{}, err
+	}
+	defer c.forgetReply(replyTopic, id)
+
+	// Don't modify the caller headers
+	headers := make(map[string][]byte, len(bm.Headers)+2)
+	for k, v := range bm.Headers {
+		headers[k] = v
+	}
+	headers[HeaderCorrelationID] = []byte(id)
+	headers[HeaderReplyTo] = []byte(c.publishTopic(replyTopic))
+	bm.Headers = headers
+
+	if err := c.Publish(ctx, requestTopic, bm); err != nil {
+		return extensions.BrokerMessage{}, err
+	}
+
+	select {
+	case msg, ok := <-reply:
+		if !ok {
+			return extensions.BrokerMessage{}, extensions.ErrSubscriptionCanceled
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return extensions.BrokerMessage{}, ctx.Err()
+	}
+}
+
+// awaitReply registers a request waiting for a reply on topic, subscribing to
+// it if needed.
+//
+// Subscribing happens without holding repliesMu, as it may be retried for a
+// while (see WithReconnect): concurrent requests may then subscribe at once,
+// the first one registered wins and the others cancel their subscription.
+func (c *Controller) awaitReply(ctx context.Context, topic, id string) (<-chan extensions.BrokerMessage, error) {
+	reply := make(chan extensions.BrokerMessage, 1)
+	if c.registerReply(topic, id, reply, nil) {
+		return reply, nil
+	}
+
+	sub, err := c.subscribeReplies(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+	if c.registerReply(topic, id, reply, &sub) {
+		go sub.Cancel(context.Background())
+	}
+
+	return reply, nil
+}
+
+// registerReply registers reply as awaiting id on topic, through the router
+// of topic if there is one, or a new one using sub otherwise. It returns
+// whether an existing router was used.
+func (c *Controller) registerReply(topic, id string, reply chan extensions.BrokerMessage, sub *extensions.BrokerChannelSubscription) bool {
+	c.repliesMu.Lock()
+	defer c.repliesMu.Unlock()
+
+	router, ok := c.replies[topic]
+	if !ok && sub == nil {
+		return false
+	}
+	if !ok {
+		router = &replyRouter{topic: topic, sub: *sub, waiters: make(map[string]chan extensions.BrokerMessage)}
+		c.replies[topic] = router
+		go c.routeReplies(router)
+	}
+	if router.idle != nil {
+		router.idle.Stop()
+		router.idle = nil
+	}
+	router.waiters[id] = reply
+
+	return ok
+}
+
+// subscribeReplies subscribes to topic, giving up when ctx is done. The
+// subscription is shared by all requests on topic, so it outlives ctx.
+func (c *Controller) subscribeReplies(ctx context.Context, topic string) (extensions.BrokerChannelSubscription, error) {
+	subCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, cancel)
+
+	sub, err := c.Subscribe(subCtx, topic)
+	if !stop() {
+		// ctx was done while subscribing, which failed or is stopping
+		return extensions.BrokerChannelSubscription{}, ctx.Err()
+	}
+
+	return sub, err
+}
+
+// forgetReply unregisters a request. If it was the last one waiting on topic,
+// the subscription is canceled unless another request comes within
+// replyIdleTimeout.
+func (c *Controller) forgetReply(topic, id string) {
+	c.repliesMu.Lock()
+	defer c.repliesMu.Unlock()
+
+	router, ok := c.replies[topic]
+	if !ok {
+		return
+	}
+
+	delete(router.waiters, id)
+	if len(router.waiters) == 0 && router.idle == nil {
+		router.idle = time.AfterFunc(replyIdleTimeout, func() { c.stopIdleRouter(router) })
+	}
+}
+
+// stopIdleRouter cancels the subscription of router, unless a request awaits
+// it again.
+func (c *Controller) stopIdleRouter(router *replyRouter) {
+	c.repliesMu.Lock()
+	defer c.repliesMu.Unlock()
+
+	if len(router.waiters) > 0 || c.replies[router.topic] != router {
+		return
+	}
+
+	delete(c.replies, router.topic)
+	go router.sub.Cancel(context.Background())
+}
+
+func (c *Controller) routeReplies(router *replyRouter) {
+	for msg := range router.sub.MessagesChannel() {
+		id := string(msg.Headers[HeaderCorrelationID])
+
+		c.repliesMu.Lock()
+		if reply, ok := router.waiters[id]; ok {
+			delete(router.waiters, id)
+			reply <- msg
+		}
+		c.repliesMu.Unlock()
+
+		if c.manualAck {
+			_ = c.Ack(msg)
+		}
+	}
+
+	// Subscription is gone, wake up requests still waiting
+	c.repliesMu.Lock()
+	defer c.repliesMu.Unlock()
+
+	if c.replies[router.topic] == router {
+		delete(c.replies, router.topic)
+	}
+	if router.idle != nil {
+		router.idle.Stop()
+	}
+
+	for id, reply := range router.waiters {
+		delete(router.waiters, id)
+		close(reply)
+	}
+}
+
+func newCorrelationID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,46 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+)
+
+func TestRequestSubscribingHonorsDeadline(t *testing.T) {
+	// Subscribing to replies keeps failing, and would be retried for minutes
+	c := newTestController(t, WithEnvelopeCodec(JSONEnvelope{}), WithReconnect(100, time.Second))
+	bm := extensions.BrokerMessage{Payload: []byte("ping")}
+
+	slowCtx, cancelSlow := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelSlow()
+	slow := make(chan error, 1)
+	go func() {
+		_, err := c.Request(slowCtx, "pings", bm, "pongs#slow")
+		slow <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Not held by the other request subscribing on its own reply topic
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.Request(ctx, "pings", bm, "pongs#fast"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Request() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Request() took %v, want it to return by its deadline", elapsed)
+	}
+
+	cancelSlow()
+	select {
+	case err := <-slow:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("canceled Request() error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request() still subscribing after its context was canceled")
+	}
+}
@@ -0,0 +1,90 @@
+package nsq
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Jitter is how retry delays are randomized, so that clients failing at once
+// don't all retry at once either.
+type Jitter int
+
+const (
+	// JitterNone keeps the exponential delays as they are.
+	JitterNone Jitter = iota + 1
+	// JitterFull picks delays between zero and their exponential value,
+	// spreading retries the most.
+	JitterFull
+	// JitterEqual picks delays between half and all of their exponential
+	// value, keeping a minimum wait.
+	JitterEqual
+)
+
+// WithRetryJitter sets how delays of WithReconnect and WithPublishRetry are
+// randomized. By default, reconnections use JitterFull and publish retries
+// JitterEqual.
+func WithRetryJitter(j Jitter) ControllerOption {
+	if j < JitterNone || j > JitterEqual {
+		return withError(fmt.Errorf("invalid retry jitter %d", j))
+	}
+
+	return func(controller *Controller) { controller.retryJitter = j }
+}
+
+// backoff is an exponential backoff policy.
+type backoff struct {
+	maxRetries int
+	baseDelay  time.Duration
+	jitter     Jitter
+	clock      clock
+	rand       randSource
+	// retryable tells which errors are worth retrying, all of them if nil.
+	retryable func(err error) bool
+}
+
+// maxRetryDelay caps retry delays before jitter, however many attempts were
+// made.
+const maxRetryDelay = 2 * time.Minute
+
+// delay returns how long to wait before the retry number attempt (from 0).
+func (b backoff) delay(attempt int) time.Duration {
+	if b.baseDelay <= 0 {
+		return 0
+	}
+
+	// Clamp before shifting, so large attempts don't overflow
+	d := maxRetryDelay
+	if attempt < 63 && b.baseDelay <= maxRetryDelay>>attempt {
+		d = b.baseDelay << attempt
+	}
+
+	switch b.jitter {
+	case JitterFull:
+		return time.Duration(b.rand.Int63n(int64(d) + 1))
+	case JitterEqual:
+		return d/2 + time.Duration(b.rand.Int63n(int64(d/2)+1))
+	default:
+		return d
+	}
+}
+
+// retry calls fn until it succeeds, retries are exhausted or ctx is done.
+// onRetry is called before waiting for each retry.
+func (b backoff) retry(ctx context.Context, fn func() error, onRetry func(attempt int, delay time.Duration, err error)) error {
+	err := fn()
+	for attempt := 0; err != nil && attempt < b.maxRetries && (b.retryable == nil || b.retryable(err)); attempt++ {
+		delay := b.delay(attempt)
+		onRetry(attempt+1, delay, err)
+
+		select {
+		case <-b.clock.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		err = fn()
+	}
+
+	return err
+}
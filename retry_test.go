@@ -0,0 +1,60 @@
+package nsq
+
+import (
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRetryJitter(t *testing.T) {
+	const baseDelay = 100 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		jitter  Jitter
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{name: "none", jitter: JitterNone, attempt: 3, min: 800 * time.Millisecond, max: 800 * time.Millisecond},
+		{name: "full", jitter: JitterFull, attempt: 3, min: 0, max: 800 * time.Millisecond},
+		{name: "equal", jitter: JitterEqual, attempt: 3, min: 400 * time.Millisecond, max: 800 * time.Millisecond},
+		{name: "none capped", jitter: JitterNone, attempt: 20, min: maxRetryDelay, max: maxRetryDelay},
+		{name: "equal capped", jitter: JitterEqual, attempt: 20, min: maxRetryDelay / 2, max: maxRetryDelay},
+		{name: "none overflowing", jitter: JitterNone, attempt: 1000, min: maxRetryDelay, max: maxRetryDelay},
+		{name: "full overflowing", jitter: JitterFull, attempt: 1000, min: 0, max: maxRetryDelay},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestController(t,
+				WithReconnect(1, baseDelay),
+				WithRetryJitter(tt.jitter),
+				withRand(rand.New(rand.NewSource(1))))
+
+			for i := 0; i < 100; i++ {
+				if d := c.reconnect.delay(tt.attempt); d < tt.min || d > tt.max {
+					t.Fatalf("delay(%d) = %v, want between %v and %v", tt.attempt, d, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryJitterDeterministic(t *testing.T) {
+	delays := func() []time.Duration {
+		c := newTestController(t, WithReconnect(1, time.Second), withRand(rand.New(rand.NewSource(42))))
+
+		delays := make([]time.Duration, 5)
+		for i := range delays {
+			delays[i] = c.reconnect.delay(i)
+		}
+
+		return delays
+	}
+
+	if first, second := delays(), delays(); !slices.Equal(first, second) {
+		t.Errorf("delays with the same seed = %v and %v, want them equal", first, second)
+	}
+}
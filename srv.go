@@ -0,0 +1,153 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+	"github.com/nsqio/go-nsq"
+)
+
+// srvResolveTimeout bounds SRV records resolution.
+const srvResolveTimeout = 10 * time.Second
+
+// srvDiscovery resolves nsqd addresses from DNS SRV records.
+type srvDiscovery struct {
+	service  string
+	resolver *net.Resolver
+	interval time.Duration
+
+	mu    sync.Mutex
+	addrs []string
+}
+
+// WithSRVDiscovery makes consumers also connect to every nsqd found in the DNS
+// SRV records of service (e.g. "_nsqd._tcp.example.com"), resolved with
+// resolver, net.DefaultResolver if nil.
+//
+// Records are resolved in NewController, which fails if none is found. See
+// WithSRVRefreshInterval to resolve them again over time.
+func WithSRVDiscovery(service string, resolver *net.Resolver) ControllerOption {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	return func(controller *Controller) {
+		controller.srv = &srvDiscovery{service: service, resolver: resolver}
+	}
+}
+
+// WithSRVRefreshInterval makes the controller resolve SRV records set with
+// WithSRVDiscovery again every interval: consumers connect to new nsqd, and
+// disconnect from removed ones. When resolution fails, a warning is logged
+// and known addresses are kept.
+func WithSRVRefreshInterval(interval time.Duration) ControllerOption {
+	if interval <= 0 {
+		return withError(fmt.Errorf("invalid SRV refresh interval %v: must be positive", interval))
+	}
+
+	return func(controller *Controller) { controller.srvRefreshInterval = interval }
+}
+
+// resolve resolves SRV records, returning addresses added and removed since
+// the last time.
+func (d *srvDiscovery) resolve(ctx context.Context) (added, removed []string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, srvResolveTimeout)
+	defer cancel()
+
+	_, records, err := d.resolver.LookupSRV(ctx, "", "", d.service)
+	if err != nil {
+		return nil, nil, fmt.Errorf("resolving SRV records of %s: %w", d.service, err)
+	}
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("resolving SRV records of %s: no record found", d.service)
+	}
+
+	addrs := make([]string, len(records))
+	for i, r := range records {
+		addrs[i] = net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)))
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, addr := range addrs {
+		if !slices.Contains(d.addrs, addr) {
+			added = append(added, addr)
+		}
+	}
+	for _, addr := range d.addrs {
+		if !slices.Contains(addrs, addr) {
+			removed = append(removed, addr)
+		}
+	}
+	d.addrs = addrs
+
+	return added, removed, nil
+}
+
+// connect is the connect step to resolved addresses.
+func (d *srvDiscovery) connect(consumer *nsq.Consumer) error {
+	d.mu.Lock()
+	addrs := slices.Clone(d.addrs)
+	d.mu.Unlock()
+
+	var errs []error
+	for _, addr := range addrs {
+		if err := nsqdConnect(addr)(consumer); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// refreshSRV resolves SRV records every refresh interval, until the
+// controller is closed.
+func (c *Controller) refreshSRV() {
+	ticker := time.NewTicker(c.srvRefreshInterval)
+	defer ticker.Stop()
+
+	ctx := context.Background()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.shutdown:
+			return
+		}
+
+		added, removed, err := c.srv.resolve(ctx)
+		if err != nil {
+			c.logger.Warning(ctx, "refreshing nsqd addresses failed",
+				extensions.LogInfo{Key: "error", Value: err.Error()})
+			continue
+		}
+
+		c.mu.Lock()
+		consumers := make([]*nsq.Consumer, 0, len(c.subscriptions))
+		for s := range c.subscriptions {
+			consumers = append(consumers, s.consumer)
+		}
+		c.mu.Unlock()
+
+		for _, consumer := range consumers {
+			for _, addr := range added {
+				if err := nsqdConnect(addr)(consumer); err != nil {
+					c.logger.Warning(ctx, "connecting consumer to discovered nsqd failed",
+						extensions.LogInfo{Key: "address", Value: addr},
+						extensions.LogInfo{Key: "error", Value: err.Error()})
+				}
+			}
+			for _, addr := range removed {
+				_ = consumer.DisconnectFromNSQD(addr)
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package nsq
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of controller counters, returned by Controller.Stats.
+// Counters are cumulative: they are only reset by creating a new controller.
+type Stats struct {
+	// Published counts messages published with Publish, PublishDeferred or
+	// PublishBatch, by topic.
+	Published map[string]uint64
+	// PublishErrors counts messages that failed to publish, by topic.
+	PublishErrors map[string]uint64
+	// Received counts messages received by subscriptions, by topic then
+	// channel.
+	Received map[string]map[string]uint64
+}
+
+// Stats returns a snapshot of controller counters, for users preferring to
+// pull them rather than plugging a MetricsRecorder.
+func (c *Controller) Stats() Stats {
+	stats := Stats{
+		Published:     c.stats.published.snapshot(),
+		PublishErrors: c.stats.publishErrors.snapshot(),
+		Received:      make(map[string]map[string]uint64),
+	}
+	for key, n := range c.stats.received.snapshot() {
+		if stats.Received[key.topic] == nil {
+			stats.Received[key.topic] = make(map[string]uint64)
+		}
+		stats.Received[key.topic][key.channel] = n
+	}
+
+	return stats
+}
+
+// stats holds counters returned by Controller.Stats.
+type stats struct {
+	published     counters[string]
+	publishErrors counters[string]
+	received      counters[topicChannel]
+}
+
+type topicChannel struct{ topic, channel string }
+
+// counters are atomic counters by key, safe for concurrent use.
+type counters[K comparable] struct {
+	m sync.Map // K -> *atomic.Uint64
+}
+
+func (cs *counters[K]) inc(key K) {
+	n, ok := cs.m.Load(key)
+	if !ok {
+		n, _ = cs.m.LoadOrStore(key, new(atomic.Uint64))
+	}
+	n.(*atomic.Uint64).Add(1)
+}
+
+func (cs *counters[K]) snapshot() map[K]uint64 {
+	snapshot := make(map[K]uint64)
+	cs.m.Range(func(key, n any) bool {
+		snapshot[key.(K)] = n.(*atomic.Uint64).Load()
+		return true
+	})
+
+	return snapshot
+}
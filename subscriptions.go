@@ -0,0 +1,31 @@
+package nsq
+
+// SubscriptionInfo describes an active subscription, see Subscriptions.
+type SubscriptionInfo struct {
+	Topic   string
+	Channel string
+	// BufferSize is how many received messages the subscription holds until
+	// they're read, see WithSubscriptionBufferSize.
+	BufferSize int
+	// Paused is set by Pause, and cleared by Resume.
+	Paused bool
+}
+
+// Subscriptions returns the subscriptions of the controller that aren't
+// stopped, in no particular order.
+func (c *Controller) Subscriptions() []SubscriptionInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	infos := make([]SubscriptionInfo, 0, len(c.subscriptions))
+	for s := range c.subscriptions {
+		infos = append(infos, SubscriptionInfo{
+			Topic:      s.topic,
+			Channel:    s.channel,
+			BufferSize: c.bufferSize,
+			Paused:     s.paused,
+		})
+	}
+
+	return infos
+}
@@ -0,0 +1,31 @@
+package nsq
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSubscriptions(t *testing.T) {
+	c := newTestController(t, WithLazyConnect(), WithSubscriptionBufferSize(8))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, topic := range []string{"orders", "payments#audit"} {
+		if _, err := c.Subscribe(ctx, topic); err != nil {
+			t.Fatalf("Subscribe(%q) error = %v", topic, err)
+		}
+	}
+
+	got := c.Subscriptions()
+	slices.SortFunc(got, func(a, b SubscriptionInfo) int { return strings.Compare(a.Topic, b.Topic) })
+	want := []SubscriptionInfo{
+		{Topic: "orders", Channel: defaultChannelName, BufferSize: 8},
+		{Topic: "payments", Channel: "audit", BufferSize: 8},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Subscriptions() = %v, want %v", got, want)
+	}
+}
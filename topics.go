@@ -0,0 +1,75 @@
+package nsq
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultChannelDelimiter separates the channel from the topic, as in
+// "topic#channel".
+const defaultChannelDelimiter = '#'
+
+// TopicChannelParser splits a topic given to Publish or Subscribe into the NSQ
+// topic and channel. An empty channel means none is set: Publish ignores it
+// anyway, and Subscribe uses the queue group or an ephemeral channel.
+type TopicChannelParser func(s string) (topic, channel string)
+
+// WithTopicChannelParser sets how the channel is parsed from topics, by default
+// split at the first '#'. A nil parser disables splitting: topics are used as
+// is, and Subscribe always uses the queue group or an ephemeral channel.
+func WithTopicChannelParser(parse TopicChannelParser) ControllerOption {
+	return func(controller *Controller) { controller.topicParser = parse }
+}
+
+// WithChannelDelimiter sets the delimiter between topic and channel, '#' by
+// default. A zero delimiter disables splitting.
+func WithChannelDelimiter(sep rune) ControllerOption {
+	if sep == 0 {
+		return WithTopicChannelParser(nil)
+	}
+
+	return WithTopicChannelParser(splitChannel(sep))
+}
+
+// WithTopicChannelMap sets the channel Subscribe uses for topics given without
+// a channel. The channel is, by precedence: the one given with the topic (e.g.
+// "orders#audit"), the one of channels[topic], an ephemeral one with
+// WithEphemeralChannel, the queue group of WithQueueGroup, then the default
+// channel.
+func WithTopicChannelMap(channels map[string]string) ControllerOption {
+	var errs []error
+	for topic, channel := range channels {
+		if err := validateName("channel", channel); err != nil {
+			errs = append(errs, fmt.Errorf("topic %q: %w", topic, err))
+		}
+	}
+	if len(errs) > 0 {
+		return withError(errors.Join(errs...))
+	}
+
+	copied := maps.Clone(channels)
+	return func(controller *Controller) { controller.topicMap = copied }
+}
+
+// parseTopic splits s with the configured parser.
+func (c *Controller) parseTopic(s string) (topic, channel string) {
+	if c.topicParser == nil {
+		return s, ""
+	}
+
+	return c.topicParser(s)
+}
+
+// splitChannel returns a parser splitting topics at the first sep.
+func splitChannel(sep rune) TopicChannelParser {
+	return func(s string) (string, string) {
+		if i := strings.IndexRune(s, sep); i >= 0 {
+			return s[:i], s[i+utf8.RuneLen(sep):]
+		}
+
+		return s, ""
+	}
+}
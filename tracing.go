@@ -0,0 +1,155 @@
+package nsq
+
+import (
+	"context"
+
+	"github.com/lerenn/asyncapi-codegen/pkg/extensions"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/quenbyako/asyncapi-nsq"
+
+// WithTracerProvider enables OpenTelemetry spans around Publish and received
+// messages handling. With an envelope codec set (see WithEnvelopeCodec), the
+// trace context also travels in message headers, linking both sides.
+func WithTracerProvider(tp trace.TracerProvider) ControllerOption {
+	return func(controller *Controller) { controller.tracer = tp.Tracer(tracerName) }
+}
+
+// WithPropagator sets how the context is propagated in message headers, by
+// default the W3C trace context and baggage. Headers are only sent with an
+// envelope codec (see WithEnvelopeCodec): without one, propagation is a no-op.
+func WithPropagator(p propagation.TextMapPropagator) ControllerOption {
+	return func(controller *Controller) { controller.propagator = p }
+}
+
+// defaultPropagator propagates the W3C trace context and baggage.
+func defaultPropagator() propagation.TextMapPropagator {
+	return propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+}
+
+// ExtractContext returns ctx with the context propagated in bm headers, such
+// as the publisher trace context and baggage. Without envelope codec, ctx is
+// returned as is.
+func (c *Controller) ExtractContext(ctx context.Context, bm extensions.BrokerMessage) context.Context {
+	if c.envelope == nil {
+		return ctx
+	}
+
+	return c.propagator.Extract(ctx, HeadersCarrier(bm.Headers))
+}
+
+// tracePublish runs publish within a producer span, injecting its context in
+// the headers of every message. Without tracer, publish is called right away,
+// still propagating ctx.
+func (c *Controller) tracePublish(ctx context.Context, topic string, msgs []extensions.BrokerMessage,
+	publish func(ctx context.Context, msgs []extensions.BrokerMessage) error,
+) error {
+	if c.tracer == nil {
+		return publish(ctx, c.injectAll(ctx, msgs))
+	}
+
+	size := 0
+	for _, bm := range msgs {
+		size += len(bm.Payload)
+	}
+	attributes := []attribute.KeyValue{
+		attribute.String("messaging.system", "nsq"),
+		attribute.String("messaging.destination", topic),
+		attribute.Int("messaging.message.body.size", size),
+	}
+	if len(msgs) > 1 {
+		attributes = append(attributes, attribute.Int("messaging.batch.message_count", len(msgs)))
+	}
+	ctx, span := c.tracer.Start(ctx, topic+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attributes...))
+	defer span.End()
+
+	err := publish(ctx, c.injectAll(ctx, msgs))
+	recordError(span, err)
+
+	return err
+}
+
+// injectAll returns msgs with ctx propagated in each of them, see inject.
+func (c *Controller) injectAll(ctx context.Context, msgs []extensions.BrokerMessage) []extensions.BrokerMessage {
+	injected := make([]extensions.BrokerMessage, len(msgs))
+	for i, bm := range msgs {
+		injected[i] = c.inject(ctx, bm)
+	}
+
+	return injected
+}
+
+// inject returns bm with ctx propagated in a copy of its headers. Without
+// envelope codec headers aren't sent, so bm is returned as is.
+func (c *Controller) inject(ctx context.Context, bm extensions.BrokerMessage) extensions.BrokerMessage {
+	if c.envelope == nil {
+		return bm
+	}
+
+	// Don't modify the caller headers
+	headers := make(map[string][]byte, len(bm.Headers))
+	for k, v := range bm.Headers {
+		headers[k] = v
+	}
+	c.propagator.Inject(ctx, HeadersCarrier(headers))
+	bm.Headers = headers
+
+	return bm
+}
+
+// traceReceive starts a consumer span, child of the trace context found in
+// message headers, and returns the function ending it with the delivery
+// error. Without tracer, end does nothing.
+func (c *Controller) traceReceive(topic, channel string, attempts uint16, bm extensions.BrokerMessage) (end func(err error)) {
+	if c.tracer == nil {
+		return func(error) {}
+	}
+
+	ctx := c.ExtractContext(context.Background(), bm)
+	_, span := c.tracer.Start(ctx, topic+" receive",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nsq"),
+			attribute.String("messaging.destination", topic),
+			attribute.String("messaging.nsq.channel", channel),
+			attribute.Int("messaging.nsq.attempts", int(attempts)),
+			attribute.Int("messaging.message.body.size", len(bm.Payload)),
+		))
+
+	return func(err error) {
+		recordError(span, err)
+		span.End()
+	}
+}
+
+func recordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// HeadersCarrier is a propagation.TextMapCarrier over broker message headers,
+// to propagate other context than WithPropagator does.
+type HeadersCarrier map[string][]byte
+
+var _ propagation.TextMapCarrier = HeadersCarrier(nil)
+
+func (h HeadersCarrier) Get(key string) string { return string(h[key]) }
+
+func (h HeadersCarrier) Set(key, value string) { h[key] = []byte(value) }
+
+func (h HeadersCarrier) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+
+	return keys
+}